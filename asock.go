@@ -0,0 +1,98 @@
+package whiplash
+
+// This file contains the client side of the Ceph admin socket
+// protocol, which is very simple. A request is a JSON-encoded command
+// terminated by a NUL byte. A response is a 4-byte big-endian length
+// followed by that many bytes of payload (usually, but not always,
+// JSON). The daemon closes the connection after replying, so there's
+// exactly one request per connection.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// asockTimeout is the default per-query deadline for talking to
+	// an admin socket, in milliseconds.
+	asockTimeout = 100
+	// asockMaxResp is the largest response we're willing to read
+	// from an admin socket. Anything claiming to be bigger than this
+	// is assumed to be garbage.
+	asockMaxResp = 64 * 1024 * 1024
+	// asockBufSize is the size of the network read buffer.
+	asockBufSize = 8192
+)
+
+// asockDispatch connects to the admin socket at s.Sock, sends `cmd`,
+// and reads the response into s.Resp. The entire exchange, including
+// the connection, must complete before s.timeout elapses.
+func (s *Svc) asockDispatch(cmd []byte) error {
+	timeout := s.timeout
+	if timeout <= 0 {
+		timeout = asockTimeout * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout("unix", s.Sock, timeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to sock %s: %s", s.Sock, err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(cmd)
+	if err != nil {
+		return fmt.Errorf("could not send request on %s: %s", s.Sock, err)
+	}
+	err = s.asockRead(conn)
+	if err != nil {
+		return fmt.Errorf("could not read reply on %s: %s", s.Sock, err)
+	}
+	return nil
+}
+
+// asockRead reads a length-prefixed admin socket response from `r`
+// into s.Resp.
+func (s *Svc) asockRead(r io.Reader) error {
+	if s.b0 == nil {
+		s.b0 = make([]byte, 4)
+		s.b1 = make([]byte, asockBufSize)
+	}
+	s.Resp = nil
+	// get the message length
+	_, err := io.ReadFull(r, s.b0)
+	if err != nil {
+		return err
+	}
+	mlen := binary.BigEndian.Uint32(s.b0)
+	if mlen > asockMaxResp {
+		return fmt.Errorf("response length %d exceeds maximum of %d", mlen, asockMaxResp)
+	}
+	s.mlen = int32(mlen)
+	s.mread = 0
+	s.b2 = make([]byte, 0, s.mlen)
+	// and read until we have all of it. the daemon may hand it to us
+	// in as many pieces as it likes.
+	for s.mread < s.mlen {
+		want := s.mlen - s.mread
+		if want > int32(len(s.b1)) {
+			want = int32(len(s.b1))
+		}
+		n, err := r.Read(s.b1[:want])
+		s.b2 = append(s.b2, s.b1[:n]...)
+		s.mread += int32(n)
+		if err == io.EOF && s.mread < s.mlen {
+			return fmt.Errorf("short response: got %d of %d bytes", s.mread, s.mlen)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	s.Resp = s.b2
+	return nil
+}
@@ -0,0 +1,177 @@
+package whiplash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAsock is a stand-in for a Ceph daemon's admin socket. It
+// answers each request by looking up the request's prefix in
+// resps. Requests with unknown prefixes are echoed back.
+type fakeAsock struct {
+	l     net.Listener
+	sock  string
+	resps map[string][]byte
+	// chunk, if nonzero, makes the server write its response in
+	// pieces of this size, pausing between each one
+	chunk int
+	// mlen, if nonzero, overrides the length prefix of the response
+	mlen uint32
+	// stall makes the server read the request but never answer it
+	stall bool
+}
+
+// newFakeAsock starts a fake admin socket listener at `sock`.
+func newFakeAsock(t *testing.T, sock string, resps map[string][]byte) *fakeAsock {
+	os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("couldn't create fake asock %s: %v", sock, err)
+	}
+	fa := &fakeAsock{l: l, sock: sock, resps: resps}
+	go fa.serve()
+	return fa
+}
+
+func (fa *fakeAsock) serve() {
+	for {
+		conn, err := fa.l.Accept()
+		if err != nil {
+			return
+		}
+		go fa.handle(conn)
+	}
+}
+
+func (fa *fakeAsock) handle(conn net.Conn) {
+	defer conn.Close()
+	req, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return
+	}
+	var cmd map[string]interface{}
+	err = json.Unmarshal(req[:len(req)-1], &cmd)
+	if err != nil {
+		return
+	}
+	if fa.stall {
+		time.Sleep(time.Second)
+		return
+	}
+	prefix, _ := cmd["prefix"].(string)
+	resp, ok := fa.resps[prefix]
+	if !ok {
+		resp = req[:len(req)-1]
+	}
+	mlen := uint32(len(resp))
+	if fa.mlen != 0 {
+		mlen = fa.mlen
+	}
+	b0 := make([]byte, 4)
+	binary.BigEndian.PutUint32(b0, mlen)
+	conn.Write(b0)
+	if fa.chunk == 0 {
+		conn.Write(resp)
+		return
+	}
+	for len(resp) > 0 {
+		n := fa.chunk
+		if n > len(resp) {
+			n = len(resp)
+		}
+		conn.Write(resp[:n])
+		resp = resp[n:]
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func (fa *fakeAsock) close() {
+	fa.l.Close()
+	os.Remove(fa.sock)
+}
+
+func TestAsockQuery(t *testing.T) {
+	vresp := []byte(`{"version":"0.94.5"}`)
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{"version": vresp})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "osd.9999"}, Sock: fa.sock, timeout: 250 * time.Millisecond}
+	// simple request
+	err := s.Query("version")
+	if err != nil {
+		t.Fatalf("version query failed: %v", err)
+	}
+	if string(s.Resp) != string(vresp) {
+		t.Errorf("expected %s but got %s", vresp, s.Resp)
+	}
+	// Ping should pick up the version
+	s.Ping()
+	if !s.Core.Reporting || s.Core.Version != "0.94.5" {
+		t.Errorf("Ping should have set reporting and version 0.94.5; got %v, %v", s.Core.Reporting, s.Core.Version)
+	}
+	// response dribbled out in pieces, bigger than our read buffer
+	big := []byte(`{"version":"` + strings.Repeat("x", asockBufSize*3) + `"}`)
+	fa.resps["version"] = big
+	fa.chunk = 1000
+	err = s.Query("version")
+	if err != nil {
+		t.Fatalf("chunked version query failed: %v", err)
+	}
+	if string(s.Resp) != string(big) {
+		t.Errorf("chunked response mangled: got %d bytes, expected %d", len(s.Resp), len(big))
+	}
+}
+
+func TestAsockQueryErrors(t *testing.T) {
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{"version": []byte(`{"version":"0.94.5"}`)})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "osd.9999"}, Sock: fa.sock, timeout: 100 * time.Millisecond}
+	// command with no prefix
+	err := s.Query("")
+	if err == nil {
+		t.Errorf("empty command should have failed")
+	}
+	// socket that doesn't exist
+	s.Sock = "./test_corpus/nosuch.asok"
+	err = s.Query("version")
+	if err == nil {
+		t.Errorf("query on nonexistent socket should have failed")
+	}
+	s.Sock = fa.sock
+	// length prefix longer than the data sent
+	fa.mlen = 1000
+	err = s.Query("version")
+	if err == nil || !strings.Contains(err.Error(), "short response") {
+		t.Errorf("short response should have failed; got %v", err)
+	}
+	// length prefix larger than we'll accept
+	fa.mlen = asockMaxResp + 1
+	err = s.Query("version")
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Errorf("oversized response should have failed; got %v", err)
+	}
+	if s.Resp != nil {
+		t.Errorf("failed query should leave Resp nil; got %v", s.Resp)
+	}
+	// daemon which never answers
+	fa.mlen = 0
+	fa.stall = true
+	start := time.Now()
+	err = s.Query("version")
+	if err == nil {
+		t.Errorf("stalled query should have timed out")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("stalled query took %v; deadline not honored", time.Since(start))
+	}
+	// and Ping should mark us as not reporting
+	s.Ping()
+	if s.Core.Reporting || s.Err == nil {
+		t.Errorf("Ping on stalled daemon should fail")
+	}
+}
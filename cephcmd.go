@@ -0,0 +1,62 @@
+package whiplash
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CephCmd is a command to be sent to a Ceph admin socket. It consists
+// of a prefix, which is the name of the command ("perf dump",
+// "config get"), and any number of named arguments.
+type CephCmd struct {
+	// Prefix is the command name
+	Prefix string
+	// Args holds the command's arguments, if any
+	Args map[string]interface{}
+}
+
+// NewCephCmd returns a CephCmd with the given prefix and no arguments.
+func NewCephCmd(prefix string) *CephCmd {
+	return &CephCmd{Prefix: prefix, Args: map[string]interface{}{}}
+}
+
+// Arg sets the argument `key` to `val` and returns the command, so
+// that calls can be chained:
+//
+//     NewCephCmd("config get").Arg("var", "osd_max_backfills")
+func (c *CephCmd) Arg(key string, val interface{}) *CephCmd {
+	if c.Args == nil {
+		c.Args = map[string]interface{}{}
+	}
+	c.Args[key] = val
+	return c
+}
+
+// Bytes serializes the command into admin socket wire format: a JSON
+// object holding the prefix and arguments, terminated by NUL.
+func (c *CephCmd) Bytes() ([]byte, error) {
+	if c.Prefix == "" {
+		return nil, fmt.Errorf("command has no prefix")
+	}
+	m := map[string]interface{}{"prefix": c.Prefix}
+	for k, v := range c.Args {
+		if k == "prefix" {
+			return nil, fmt.Errorf("'prefix' can't be used as an argument name")
+		}
+		m[k] = v
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, 0), nil
+}
+
+// String returns the command's JSON form, without the terminator.
+func (c *CephCmd) String() string {
+	b, err := c.Bytes()
+	if err != nil {
+		return c.Prefix
+	}
+	return string(b[:len(b)-1])
+}
@@ -0,0 +1,63 @@
+package whiplash
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCephCmdBytes(t *testing.T) {
+	tests := []struct {
+		cmd *CephCmd
+		out string
+	}{
+		{NewCephCmd("version"), `{"prefix":"version"}`},
+		{NewCephCmd("perf dump"), `{"prefix":"perf dump"}`},
+		{NewCephCmd("config get").Arg("var", "osd_max_backfills"),
+			`{"prefix":"config get","var":"osd_max_backfills"}`},
+		{NewCephCmd("dump_historic_ops"), `{"prefix":"dump_historic_ops"}`},
+		{NewCephCmd("perf dump").Arg("logger", "osd").Arg("counter", "op_r"),
+			`{"counter":"op_r","logger":"osd","prefix":"perf dump"}`},
+		{&CephCmd{Prefix: "mon_status"}, `{"prefix":"mon_status"}`},
+	}
+	for _, test := range tests {
+		b, err := test.cmd.Bytes()
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.out, err)
+			continue
+		}
+		if b[len(b)-1] != 0 {
+			t.Errorf("%v: command not NUL-terminated", test.out)
+		}
+		if string(b[:len(b)-1]) != test.out {
+			t.Errorf("expected %v but got %s", test.out, b[:len(b)-1])
+		}
+		if test.cmd.String() != test.out {
+			t.Errorf("String() should be %v but is %v", test.out, test.cmd.String())
+		}
+	}
+	// and things which should fail
+	_, err := NewCephCmd("").Bytes()
+	if err == nil {
+		t.Errorf("command with no prefix should fail")
+	}
+	_, err = NewCephCmd("config get").Arg("prefix", "status").Bytes()
+	if err == nil {
+		t.Errorf("command with 'prefix' arg should fail")
+	}
+}
+
+func TestQueryCmd(t *testing.T) {
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "osd.9999"}, Sock: fa.sock, timeout: 250 * time.Millisecond}
+	// the fake asock echoes unknown commands, so we should get our
+	// request back
+	cmd := NewCephCmd("config get").Arg("var", "osd_max_backfills")
+	err := s.QueryCmd(cmd)
+	if err != nil {
+		t.Fatalf("config get failed: %v", err)
+	}
+	if string(s.Resp) != cmd.String() {
+		t.Errorf("expected %v but got %s", cmd, s.Resp)
+	}
+}
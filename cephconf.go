@@ -0,0 +1,325 @@
+package whiplash
+
+// This file contains a parser for Ceph configuration files, which
+// follows the rules Ceph itself uses:
+//
+//   * comments start with '#' or ';', either at the start of a line
+//     or after a value. '\#' and '\;' are literal.
+//   * values may be double-quoted, with '\"' and '\\' escapes, to
+//     preserve whitespace and comment characters
+//   * a line ending in '\' continues onto the next line
+//   * in keys, spaces and underscores are interchangeable, so
+//     "admin_socket" and "admin socket" are the same key. We
+//     normalize to spaces.
+//   * settings before the first section header are global
+//
+// On top of that, "include PATH" lines pull in other files. PATH may
+// be a glob, and is relative to the including file.
+//
+// The settings for a given daemon are resolved by layering [global],
+// then the daemon type's section, then the daemon's own section, and
+// expanding metavariables like $name and $cluster in the result.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// cephConfMaxDepth limits how deeply includes may nest. It is
+	// also what stops include loops.
+	cephConfMaxDepth = 8
+	// cephConfMaxValue caps the length of an expanded value. Past
+	// it, metavariables are left unexpanded.
+	cephConfMaxValue = 4096
+	// cephConfMaxSubst caps the number of metavariables substituted
+	// while expanding one value, since settings which refer to each
+	// other several times over can take exponential work even when
+	// what they expand to is small.
+	cephConfMaxSubst = 256
+)
+
+// cephConfDefaults are the settings Ceph assumes if nothing else sets
+// them, for the keys we care about.
+var cephConfDefaults = map[string]string{
+	"run dir": "/var/run/ceph",
+	"admin socket": "$run_dir/$cluster-$name.asok",
+	"mon data": "/var/lib/ceph/mon/$cluster-$id",
+}
+
+// cephMetavar matches $var and ${var}.
+var cephMetavar = regexp.MustCompile(`\$(\{[A-Za-z0-9_]+\}|[A-Za-z0-9_]+)`)
+
+// parseCephConf reads a Ceph configuration file, and turns it into a
+// map of maps. The top-level map has the conf file section names as
+// keys. The second-level maps contain the key-value pairs of each
+// section of the configuration, with keys normalized.
+func parseCephConf(cephconf string) (map[string]map[string]string, error) {
+	cm := make(map[string]map[string]string)
+	err := readCephConf(cephconf, cm, 0)
+	if err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// readCephConf parses the file at `path` into `cm`, following any
+// includes.
+func readCephConf(path string, cm map[string]map[string]string, depth int) error {
+	if depth > cephConfMaxDepth {
+		return fmt.Errorf("%s: includes nested more than %d deep", path, cephConfMaxDepth)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = parseCephConfData(f, cm, func(inc string) error {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		matches, err := filepath.Glob(inc)
+		if err != nil {
+			return err
+		}
+		if matches == nil && !strings.ContainsAny(inc, "*?[") {
+			return fmt.Errorf("included file %s does not exist", inc)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if err := readCephConf(m, cm, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// parseCephConfData parses Ceph configuration from `r` into
+// `cm`. Include lines are handed to `include`; if it is nil, they are
+// an error. Each included file starts out in [global], and parsing
+// resumes in the current section afterwards.
+func parseCephConfData(r io.Reader, cm map[string]map[string]string, include func(string) error) error {
+	scanner := bufio.NewScanner(r)
+	section := "global"
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		start := lineno
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// join continued lines
+		for strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			line = line[:len(line)-1]
+			if !scanner.Scan() {
+				break
+			}
+			lineno++
+			line += strings.TrimRight(scanner.Text(), "\r")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		// section headers
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return fmt.Errorf("line %d: unterminated section header", start)
+			}
+			if rest := strings.TrimSpace(line[end+1:]); rest != "" && rest[0] != '#' && rest[0] != ';' {
+				return fmt.Errorf("line %d: junk after section header", start)
+			}
+			section = strings.TrimSpace(line[1:end])
+			if section == "" {
+				return fmt.Errorf("line %d: empty section name", start)
+			}
+			if cm[section] == nil {
+				cm[section] = map[string]string{}
+			}
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		// includes
+		if eq < 0 && strings.HasPrefix(line, "include") {
+			path := strings.TrimSpace(strings.TrimPrefix(line, "include"))
+			if path == "" || path == line[len("include"):] && !unicode.IsSpace(rune(line[len("include")])) {
+				return fmt.Errorf("line %d: bad include", start)
+			}
+			if include == nil {
+				return fmt.Errorf("line %d: includes not allowed here", start)
+			}
+			if err := include(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if eq < 0 {
+			return fmt.Errorf("line %d: expected 'key = value'", start)
+		}
+		key := cephConfKey(line[:eq])
+		if key == "" {
+			return fmt.Errorf("line %d: empty key", start)
+		}
+		val, err := cephConfValue(line[eq+1:])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", start, err)
+		}
+		if cm[section] == nil {
+			cm[section] = map[string]string{}
+		}
+		cm[section][key] = val
+	}
+	return scanner.Err()
+}
+
+// cephConfKey normalizes a key: runs of spaces, tabs, and underscores
+// become single spaces, and surrounding whitespace is removed.
+func cephConfKey(k string) string {
+	return strings.Join(strings.FieldsFunc(k, func(r rune) bool {
+		return r == '_' || unicode.IsSpace(r)
+	}), " ")
+}
+
+// cephConfValue extracts the value from the part of a line after the
+// '=', dealing with quotes, escapes, and trailing comments.
+func cephConfValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	b := &strings.Builder{}
+	if strings.HasPrefix(s, "\"") {
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				b.WriteByte(s[i])
+			case '"':
+				rest := strings.TrimSpace(s[i+1:])
+				if rest != "" && rest[0] != '#' && rest[0] != ';' {
+					return "", fmt.Errorf("junk after quoted value")
+				}
+				return b.String(), nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", fmt.Errorf("unterminated quoted value")
+	}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '#' || s[i+1] == ';') {
+				i++
+			}
+			b.WriteByte(s[i])
+		case '#', ';':
+			return strings.TrimSpace(b.String()), nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// cephDaemonConf returns the settings which apply to the daemon
+// `name` (such as "osd.3" or "client.radosgw.gw1") in `cm`, with
+// metavariables expanded. `cluster` and `host` are the values of
+// $cluster and $host.
+func cephDaemonConf(cm map[string]map[string]string, cluster, host, name string) map[string]string {
+	typ, id := name, ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		typ, id = name[:i], name[i+1:]
+	}
+	settings := map[string]string{}
+	for k, v := range cephConfDefaults {
+		settings[k] = v
+	}
+	for _, section := range []string{"global", typ, name} {
+		for k, v := range cm[section] {
+			settings[k] = v
+		}
+	}
+	meta := map[string]string{
+		"cluster": cluster,
+		"type": typ,
+		"id": id,
+		"name": name,
+		"host": host,
+	}
+	resolved := make(map[string]string, len(settings))
+	for k, v := range settings {
+		ce := &cephExpander{meta: meta, settings: settings, chain: map[string]bool{k: true}, subst: cephConfMaxSubst}
+		resolved[k] = ce.expand(v)
+	}
+	return resolved
+}
+
+// cephExpander expands the metavariables in a setting's value. A
+// variable is either one of the fixed metavariables in `meta`, or the
+// name of another setting. Unknown variables are left alone, as are
+// ones which would refer back to a setting already being expanded.
+type cephExpander struct {
+	meta map[string]string
+	settings map[string]string
+	// chain holds the settings being expanded, outermost first
+	chain map[string]bool
+	// subst is how many more substitutions we're willing to make
+	subst int
+}
+
+// expand returns `v` with its metavariables expanded, within the
+// limits of cephConfMaxValue and ce.subst.
+func (ce *cephExpander) expand(v string) string {
+	if !strings.Contains(v, "$") {
+		return v
+	}
+	b := &strings.Builder{}
+	last := 0
+	for _, loc := range cephMetavar.FindAllStringIndex(v, -1) {
+		b.WriteString(v[last:loc[0]])
+		last = loc[1]
+		m := v[loc[0]:loc[1]]
+		if ce.subst <= 0 || b.Len() >= cephConfMaxValue {
+			b.WriteString(m)
+			continue
+		}
+		ce.subst--
+		name := strings.Trim(m[1:], "{}")
+		key := cephConfKey(name)
+		exp := m
+		if val, ok := ce.meta[name]; ok {
+			exp = val
+		} else if val, ok := ce.settings[key]; ok && !ce.chain[key] {
+			ce.chain[key] = true
+			exp = ce.expand(val)
+			delete(ce.chain, key)
+		}
+		if b.Len()+len(exp) > cephConfMaxValue {
+			exp = m
+		}
+		b.WriteString(exp)
+	}
+	b.WriteString(v[last:])
+	return b.String()
+}
+
+// cephCluster returns the cluster name implied by the path of a Ceph
+// configuration file, which Ceph expects to be $cluster.conf.
+func cephCluster(cephconf string) string {
+	cluster := strings.TrimSuffix(filepath.Base(cephconf), ".conf")
+	if cluster == "" || cluster == "." || strings.ContainsAny(cluster, "./") {
+		return "ceph"
+	}
+	return cluster
+}
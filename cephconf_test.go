@@ -0,0 +1,266 @@
+package whiplash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCephConfData(t *testing.T) {
+	tests := []struct {
+		conf string
+		want map[string]map[string]string
+	}{
+		// keys before any section are global, and keys are normalized
+		{"fsid = abc\n[osd]\nadmin_socket = /s\n  osd__max  backfills=2\n",
+			map[string]map[string]string{
+				"global": {"fsid": "abc"},
+				"osd": {"admin socket": "/s", "osd max backfills": "2"},
+			}},
+		// comments of both kinds, inline and whole-line
+		{"; top\n[global]\n# hash\nk1 = v1 # hash\nk2 = v2;semi\nk3 = a\\#b\\;c\n",
+			map[string]map[string]string{
+				"global": {"k1": "v1", "k2": "v2", "k3": "a#b;c"},
+			}},
+		// quoted values keep whitespace and comment characters
+		{"[global]\nk = \"  a # b ; \\\"c\\\" \\\\ \" # comment\n",
+			map[string]map[string]string{
+				"global": {"k": "  a # b ; \"c\" \\ "},
+			}},
+		// continuations
+		{"[mon]\nmon host = a,\\\n  b,\\\r\n c\nnext = 1\n",
+			map[string]map[string]string{
+				"mon": {"mon host": "a,  b, c", "next": "1"},
+			}},
+		// section headers with comments, repeated sections merge, later
+		// values win
+		{"[osd] # osds\na = 1\nb = 1\n[global]\n[ osd ]\nb = 2\n",
+			map[string]map[string]string{
+				"osd": {"a": "1", "b": "2"},
+				"global": {},
+			}},
+		// empty values
+		{"[global]\nk =\nj = # nothing\n",
+			map[string]map[string]string{
+				"global": {"k": "", "j": ""},
+			}},
+	}
+	for i, test := range tests {
+		cm := map[string]map[string]string{}
+		err := parseCephConfData(strings.NewReader(test.conf), cm, nil)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(cm, test.want) {
+			t.Errorf("test %d: expected %v but got %v", i, test.want, cm)
+		}
+	}
+}
+
+func TestParseCephConfDataErrors(t *testing.T) {
+	for _, conf := range []string{
+		"[osd\n",
+		"[]\n",
+		"[osd] junk\n",
+		"[osd]\nnot a setting\n",
+		"[osd]\n = value\n",
+		"[osd]\nk = \"unterminated\n",
+		"[osd]\nk = \"quoted\" junk\n",
+		"include foo.conf\n",
+	} {
+		cm := map[string]map[string]string{}
+		if err := parseCephConfData(strings.NewReader(conf), cm, nil); err == nil {
+			t.Errorf("%q should have failed, but parsed to %v", conf, cm)
+		}
+	}
+}
+
+func TestParseCephConfInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wlcephconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"ceph.conf": "[global]\nfsid = abc\ninclude conf.d/*.conf\nafter = 1\n[osd]\nk = top\n",
+		"conf.d/10-osd.conf": "[osd]\nk = inc\nj = inc\n",
+		"conf.d/20-global.conf": "top = 2\n",
+		"loop.conf": "include loop.conf\n",
+		"missing.conf": "include nope.conf\n",
+	}
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	for name, body := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm, err := parseCephConf(filepath.Join(dir, "ceph.conf"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 'after' should land in [global], since the include doesn't
+	// change the including file's section
+	want := map[string]map[string]string{
+		"global": {"fsid": "abc", "top": "2", "after": "1"},
+		"osd": {"k": "top", "j": "inc"},
+	}
+	if !reflect.DeepEqual(cm, want) {
+		t.Errorf("expected %v but got %v", want, cm)
+	}
+	for _, name := range []string{"loop.conf", "missing.conf"} {
+		if _, err := parseCephConf(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s should have failed to parse", name)
+		}
+	}
+}
+
+func TestCephDaemonConf(t *testing.T) {
+	cm := map[string]map[string]string{
+		"global": {
+			"run dir": "/run/ceph",
+			"keyring": "/etc/ceph/$cluster.$name.keyring",
+			"log file": "/var/log/ceph/${cluster}-$name.log",
+			"loop": "$loop!",
+			"ping": "ping $pong",
+			"pong": "pong $ping",
+			"boom": "$boom$boom$boom$boom$boom$boom$boom$boom",
+			"fan1": "$fan2$fan2$fan2$fan2$fan2$fan2$fan2$fan2",
+			"fan2": "$fan3$fan3$fan3$fan3$fan3$fan3$fan3$fan3",
+			"fan3": "$fan4$fan4$fan4$fan4$fan4$fan4$fan4$fan4",
+			"fan4": "$fan5$fan5$fan5$fan5$fan5$fan5$fan5$fan5",
+			"fan5": "$fan6$fan6$fan6$fan6$fan6$fan6$fan6$fan6",
+			"fan6": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx",
+		},
+		"osd": {
+			"osd data": "/srv/$type/$id",
+			"log file": "/var/log/ceph/$type.log",
+		},
+		"osd.3": {
+			"host": "store1",
+			"log file": "/logs/$host/$name $unknown",
+		},
+	}
+	got := cephDaemonConf(cm, "prod", "store1", "osd.3")
+	want := map[string]string{
+		"admin socket": "/run/ceph/prod-osd.3.asok",
+		"host": "store1",
+		"keyring": "/etc/ceph/prod.osd.3.keyring",
+		"log file": "/logs/store1/osd.3 $unknown",
+		"osd data": "/srv/osd/3",
+		"mon data": "/var/lib/ceph/mon/prod-3",
+		"run dir": "/run/ceph",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s should be %q but is %q", k, v, got[k])
+		}
+	}
+	// references back into the chain being expanded are left alone
+	cycles := map[string]string{
+		"loop": "$loop!",
+		"ping": "ping pong $ping",
+		"pong": "pong ping $pong",
+		"boom": "$boom$boom$boom$boom$boom$boom$boom$boom",
+	}
+	for k, v := range cycles {
+		if got[k] != v {
+			t.Errorf("%s should be %q but is %q", k, v, got[k])
+		}
+	}
+	// and settings which fan out are capped
+	if len(got["fan1"]) > cephConfMaxValue+len(cm["global"]["fan1"]) {
+		t.Errorf("fan1 expanded to %d bytes", len(got["fan1"]))
+	}
+	if !strings.HasPrefix(got["fan1"], "xxxxxxxx") || !strings.Contains(got["fan1"], "$fan") {
+		t.Errorf("fan1 should be partly expanded, but is %.40q...", got["fan1"])
+	}
+	// other OSDs get the [osd] and [global] settings only
+	got = cephDaemonConf(cm, "prod", "store2", "osd.4")
+	if got["log file"] != "/var/log/ceph/osd.log" || got["host"] != "" {
+		t.Errorf("osd.4 picked up the wrong settings: %v", got)
+	}
+	// and clients get [global] only
+	got = cephDaemonConf(cm, "prod", "gw1", "client.rgw.gw1")
+	if got["log file"] != "/var/log/ceph/prod-client.rgw.gw1.log" || got["osd data"] != "" {
+		t.Errorf("client.rgw.gw1 picked up the wrong settings: %v", got)
+	}
+}
+
+func TestCephCluster(t *testing.T) {
+	for path, cluster := range map[string]string{
+		"/etc/ceph/ceph.conf": "ceph",
+		"/etc/ceph/prod.conf": "prod",
+		"./test_corpus/ceph.osd.conf": "ceph",
+		"": "ceph",
+	} {
+		if got := cephCluster(path); got != cluster {
+			t.Errorf("%q should give cluster %q but gave %q", path, cluster, got)
+		}
+	}
+}
+
+// renderCephConf writes cm back out as a Ceph configuration file, with
+// every value quoted.
+func renderCephConf(cm map[string]map[string]string) string {
+	b := &strings.Builder{}
+	for section, kv := range cm {
+		b.WriteString("[" + section + "]\n")
+		for k, v := range kv {
+			v = strings.Replace(v, "\\", "\\\\", -1)
+			v = strings.Replace(v, "\"", "\\\"", -1)
+			b.WriteString(k + " = \"" + v + "\"\n")
+		}
+	}
+	return b.String()
+}
+
+func FuzzParseCephConf(f *testing.F) {
+	for _, name := range []string{"ceph.mon.conf", "ceph.osd.conf", "ceph.rgw.conf"} {
+		conf, err := ioutil.ReadFile(filepath.Join("test_corpus", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(conf))
+	}
+	f.Add("k = v\n[a]\nk_2 = \"q \\\" ;\" ; c\nx = 1\\\n2\n")
+	f.Add("a = $a$a$a$a$a$a$a$a\nb = $c$c\nc = $b$b\n")
+	f.Fuzz(func(t *testing.T, conf string) {
+		cm := map[string]map[string]string{}
+		if err := parseCephConfData(strings.NewReader(conf), cm, nil); err != nil {
+			return
+		}
+		for section, kv := range cm {
+			if section == "" || strings.TrimSpace(section) != section {
+				t.Fatalf("bad section name %q", section)
+			}
+			for k, v := range kv {
+				if k != cephConfKey(k) || k == "" {
+					t.Fatalf("key %q is not normalized", k)
+				}
+				if strings.ContainsAny(v, "\n") {
+					t.Fatalf("value %q contains a newline", v)
+				}
+			}
+		}
+		// whatever we parsed should survive a round trip
+		cm2 := map[string]map[string]string{}
+		if err := parseCephConfData(strings.NewReader(renderCephConf(cm)), cm2, nil); err != nil {
+			t.Fatalf("rendered conf failed to parse: %v", err)
+		}
+		if !reflect.DeepEqual(cm, cm2) {
+			t.Fatalf("round trip changed %v into %v", cm, cm2)
+		}
+		// and resolving it shouldn't blow up
+		for section := range cm {
+			for k, v := range cephDaemonConf(cm, "ceph", "host", section) {
+				if len(v) > cephConfMaxValue+len(conf)+len(cephConfDefaults[k]) {
+					t.Fatalf("%s expanded to %d bytes", k, len(v))
+				}
+			}
+		}
+	})
+}
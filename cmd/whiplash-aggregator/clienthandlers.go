@@ -2,13 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/sboyettedh/whiplash"
 )
 
 // These functions are the handlers for whiplash-aggregator's client
 // side asock instance.
+//
+// Updates are recorded in lastseen at the time they arrive, by our
+// own clock. The timestamp a client puts on an update comes from its
+// clock, which may be skewed, so it is only passed through to the
+// sinks, as the time the data was sampled.
 
 // pingHandler accepts and processes ping updates.
 func pingHandler(args [][]byte) ([]byte, error) {
@@ -17,34 +24,137 @@ func pingHandler(args [][]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	// have we encountered this service before?
-	ok := host2svcs.hostexists(upd.Svc.Host)
-	if !ok {
-		// no. add it to the host-to-svc map
-		host2svcs.set(upd.Svc.Host, upd.Svc.Name)
+	if upd.Svc == nil {
+		return nil, fmt.Errorf("ping update has no service info")
 	}
-	// now add service to svcs and upds
-	svcstat.set(upd.Svc.Name, upd.Svc)
-	lastseen.set(upd.Svc.Name, "ping", upd.Time)
+	now := time.Now().Unix()
+	// add service to svcs and upds
+	setSvc(upd.Svc)
+	lastseen.set(upd.Svc.Name, "ping", now)
+	updateState(upd.Svc.Name, now)
 	log.Println("ping", upd.Svc.Name)
 	return success, nil
 }
 
 // statHandler accepts and processes stat updates.
 func statHandler(args [][]byte) ([]byte, error) {
-/*	upd := &whiplash.ClientUpdate{}
+	upd := &whiplash.ClientUpdate{}
 	// unpack the update
 	err := json.Unmarshal(args[0], upd)
 	if err != nil {
 		return nil, err
 	}
-	// unpack and update the status
-	if upd.Svc.Type == whiplash.OSD {
-		var stat *whiplash.OsdStat
+	if upd.Svc == nil {
+		return nil, fmt.Errorf("stat update has no service info")
+	}
+	// unpack the payload according to service type, and store it
+	var data interface{}
+	switch upd.Svc.Type {
+	case whiplash.OSD:
+		stat := &whiplash.OsdStat{}
+		err = json.Unmarshal(upd.Payload, stat)
+		if err == nil {
+			svcdata.setOsd(upd.Svc.Name, stat)
+			data = crushmap.weigh(upd.Svc.Name, stat)
+		}
+	case whiplash.MON:
+		stat := &whiplash.MonStat{}
 		err = json.Unmarshal(upd.Payload, stat)
-		osdstats[upd.Svc.Name] = stat
+		if err == nil {
+			svcdata.setMon(upd.Svc.Name, stat)
+			data = stat
+		}
+	case whiplash.RGW:
+		stat := &whiplash.RgwStat{}
+		err = json.Unmarshal(upd.Payload, stat)
+		if err == nil {
+			svcdata.setRgw(upd.Svc.Name, stat)
+			data = stat
+		}
+	default:
+		err = fmt.Errorf("unknown service type %d", upd.Svc.Type)
+	}
+	if err != nil {
+		log.Println("stat", upd.Svc.Name, "failed:", err)
+		return nil, err
+	}
+	now := time.Now().Unix()
+	setSvc(upd.Svc)
+	lastseen.set(upd.Svc.Name, "stat", now)
+	updateState(upd.Svc.Name, now)
+	sendSinks(upd.Svc, upd.Time, data)
+	log.Println("stat", upd.Svc.Name)
+	return success, nil
+}
+
+// addedHandler accepts notices of services which a client has newly
+// discovered. The service is registered right away, rather than when
+// its first ping arrives.
+func addedHandler(args [][]byte) ([]byte, error) {
+	upd := &whiplash.ClientUpdate{}
+	err := json.Unmarshal(args[0], upd)
+	if err != nil {
+		return nil, err
+	}
+	if upd.Svc == nil {
+		return nil, fmt.Errorf("added update has no service info")
+	}
+	now := time.Now().Unix()
+	setSvc(upd.Svc)
+	lastseen.set(upd.Svc.Name, "added", now)
+	updateState(upd.Svc.Name, now)
+	log.Println("added", upd.Svc.Name, "on", upd.Svc.Host)
+	return success, nil
+}
+
+// removedHandler accepts notices of services which have gone away
+// from a client's host, and forgets everything we know about them.
+func removedHandler(args [][]byte) ([]byte, error) {
+	upd := &whiplash.ClientUpdate{}
+	err := json.Unmarshal(args[0], upd)
+	if err != nil {
+		return nil, err
+	}
+	if upd.Svc == nil {
+		return nil, fmt.Errorf("removed update has no service info")
+	}
+	if !pruneSvc(upd.Svc.Name, upd.Svc.Host) {
+		log.Println("removed", upd.Svc.Name, "on", upd.Svc.Host, "ignored; service is elsewhere")
+		return success, nil
 	}
-	upds[upd.Svc.Name]["stat"] = upd.Time
-*/
+	log.Println("removed", upd.Svc.Name, "on", upd.Svc.Host)
 	return success, nil
 }
+
+// pruneSvc drops `svcname` from all service state, as long as it is
+// still on `hostname`. If it has moved, the removal is stale and
+// nothing is done. It returns whether the service was pruned.
+func pruneSvc(svcname, hostname string) bool {
+	if host, ok := svchosts.getHost(svcname); ok && host != hostname {
+		return false
+	}
+	svchosts.remove(svcname)
+	svcstat.remove(svcname)
+	svcdata.remove(svcname)
+	lastseen.remove(svcname)
+	return true
+}
+
+// osdStat returns the latest stat for an OSD, with its weights from
+// the current CRUSH map, or nil if no stat has been seen.
+func osdStat(svcname string) *whiplash.OsdStat {
+	return crushmap.weigh(svcname, svcdata.getOsd(svcname))
+}
+
+// setSvc stores the core status from a client update, and indexes
+// the service under the host it reported from, which moves it if it
+// was somewhere else before. The client doesn't know the service's
+// liveness state, so that is carried over from what we had before.
+func setSvc(svc *whiplash.SvcCore) {
+	svc.State = ""
+	if old := svcstat.get(svc.Name); old != nil {
+		svc.State = old.State
+	}
+	svcstat.set(svc.Name, svc)
+	svchosts.set(svc.Host, svc.Name)
+}
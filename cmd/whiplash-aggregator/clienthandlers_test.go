@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// clientUpdate builds the argument a client handler receives.
+func clientUpdate(t *testing.T, u *whiplash.ClientUpdate) [][]byte {
+	b, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{b}
+}
+
+func TestAddedRemoved(t *testing.T) {
+	name := "osd.88"
+	now := time.Now().Unix()
+	svc := &whiplash.SvcCore{Name: name, Type: whiplash.OSD, Host: "store88"}
+	_, err := addedHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: svc}))
+	if err != nil {
+		t.Fatalf("added failed: %v", err)
+	}
+	if got := svcstat.get(name); got == nil || got.State != "" {
+		t.Fatalf("%s should be registered with no state yet; got %v", name, got)
+	}
+	if svcs := svchosts.getSvcs("store88"); len(svcs) != 1 || svcs[0] != name {
+		t.Errorf("store88 should have %s; got %v", name, svcs)
+	}
+	// no ping yet, but still within the grace period
+	updateState(name, lastseen.get(name, "added")+30)
+	if got := svcstat.get(name).State; got != "" {
+		t.Errorf("%s shouldn't be judged during its grace period; got %s", name, got)
+	}
+	// once it has checked in, it's judged as normal
+	_, err = pingHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: svc, Payload: json.RawMessage("null")}))
+	if err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if got := svcstat.get(name).State; got != whiplash.SvcUp {
+		t.Errorf("%s should be up after pinging; got %s", name, got)
+	}
+	svcdata.setOsd(name, &whiplash.OsdStat{})
+
+	// removal from a host the service isn't on is ignored
+	other := &whiplash.SvcCore{Name: name, Type: whiplash.OSD, Host: "store99"}
+	_, err = removedHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: other}))
+	if err != nil {
+		t.Fatalf("removed failed: %v", err)
+	}
+	if svcstat.get(name) == nil {
+		t.Fatalf("%s was pruned by a removal from the wrong host", name)
+	}
+	// but from its own host, everything goes
+	_, err = removedHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: svc}))
+	if err != nil {
+		t.Fatalf("removed failed: %v", err)
+	}
+	if svcstat.get(name) != nil || svcdata.getOsd(name) != nil || lastseen.get(name, "ping") != 0 {
+		t.Errorf("%s should have been pruned", name)
+	}
+	if _, ok := svchosts.getHost(name); ok || svchosts.hostexists("store88") {
+		t.Errorf("%s should have been dropped from the host index", name)
+	}
+
+	// an announced service which never checks in is gone eventually
+	_, err = addedHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: svc}))
+	if err != nil {
+		t.Fatalf("added failed: %v", err)
+	}
+	updateState(name, lastseen.get(name, "added")+61)
+	if got := svcstat.get(name).State; got != whiplash.SvcGone {
+		t.Errorf("%s should be gone after its grace period; got %s", name, got)
+	}
+	pruneSvc(name, "store88")
+	// and bad updates are refused
+	if _, err := addedHandler([][]byte{[]byte("{}")}); err == nil {
+		t.Errorf("added with no service should have failed")
+	}
+	if _, err := removedHandler([][]byte{[]byte("junk")}); err == nil {
+		t.Errorf("removed with junk should have failed")
+	}
+	if _, err := pingHandler([][]byte{[]byte("{}")}); err == nil {
+		t.Errorf("ping with no service should have failed")
+	}
+}
+
+func TestStatHandler(t *testing.T) {
+	defer freshStores()()
+	now := time.Now().Unix()
+	osd := &whiplash.SvcCore{Name: "osd.1", Type: whiplash.OSD, Host: "store1", Reporting: true}
+	mon := &whiplash.SvcCore{Name: "mon.a", Type: whiplash.MON, Host: "store1", Reporting: true}
+	rgw := &whiplash.SvcCore{Name: "client.radosgw.gw1", Type: whiplash.RGW, Host: "gw1", Reporting: true}
+	tests := []struct {
+		svc *whiplash.SvcCore
+		payload string
+	}{
+		{osd, `{"BytesUsed": 100, "BytesAvail": 900}`},
+		{mon, `{"Rank": 0, "State": "leader", "Quorum": ["a", "b"]}`},
+		{rgw, `{"Req": 10, "FailedReq": 1, "GetBytes": 4096}`},
+	}
+	for _, test := range tests {
+		_, err := statHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: test.svc, Payload: json.RawMessage(test.payload)}))
+		if err != nil {
+			t.Errorf("%s: stat failed: %v", test.svc.Name, err)
+		}
+		if svcstat.get(test.svc.Name) == nil || lastseen.get(test.svc.Name, "stat") < now {
+			t.Errorf("%s: stat update not recorded", test.svc.Name)
+		}
+		if svcs := svchosts.getSvcs(test.svc.Host); len(svcs) == 0 {
+			t.Errorf("%s: not indexed under %s", test.svc.Name, test.svc.Host)
+		}
+	}
+	if st := svcdata.getOsd("osd.1"); st == nil || st.BytesUsed != 100 || st.BytesAvail != 900 {
+		t.Errorf("bad osd stat: %+v", st)
+	}
+	if ms := svcdata.getMon("mon.a"); ms == nil || ms.State != "leader" || len(ms.Quorum) != 2 {
+		t.Errorf("bad mon stat: %+v", ms)
+	}
+	if rs := svcdata.getRgw("client.radosgw.gw1"); rs == nil || rs.Req != 10 || rs.GetBytes != 4096 {
+		t.Errorf("bad rgw stat: %+v", rs)
+	}
+	// stats land in the store for the service's type only
+	if svcdata.getOsd("mon.a") != nil || svcdata.getMon("osd.1") != nil {
+		t.Errorf("stats stored under the wrong type")
+	}
+
+	// failures leave the stores alone
+	bad := &whiplash.SvcCore{Name: "osd.2", Type: whiplash.OSD, Host: "store2"}
+	odd := &whiplash.SvcCore{Name: "mds.a", Type: 99, Host: "store2"}
+	for name, arg := range map[string][]byte{
+		"malformed update": []byte("junk"),
+		"missing svc": clientUpdate(t, &whiplash.ClientUpdate{Time: now, Payload: json.RawMessage(`{}`)})[0],
+		"malformed payload": clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: bad, Payload: json.RawMessage(`{"BytesUsed": "lots"}`)})[0],
+		"unknown type": clientUpdate(t, &whiplash.ClientUpdate{Time: now, Svc: odd, Payload: json.RawMessage(`{}`)})[0],
+	} {
+		if _, err := statHandler([][]byte{arg}); err == nil {
+			t.Errorf("%s should have failed", name)
+		}
+	}
+	if svcstat.get("osd.2") != nil || svcdata.getOsd("osd.2") != nil || svcstat.get("mds.a") != nil || svchosts.hostexists("store2") {
+		t.Errorf("failed stat updates were recorded")
+	}
+}
+
+// sinkFunc is a sink which hands each update to a func.
+type sinkFunc func(svc *whiplash.SvcCore, t int64, fields map[string]float64)
+
+func (f sinkFunc) send(svc *whiplash.SvcCore, t int64, fields map[string]float64) {
+	f(svc, t, fields)
+}
+
+// A client with a skewed clock doesn't make its services look late,
+// or keep them looking fresh; only when updates arrive counts. Its
+// timestamps still go to the sinks, as when the data was sampled.
+func TestClientClockSkew(t *testing.T) {
+	defer freshStores()()
+	var sunk int64
+	defer func(old []sink) { sinks = old }(sinks)
+	sinks = []sink{sinkFunc(func(svc *whiplash.SvcCore, t int64, fields map[string]float64) { sunk = t })}
+
+	svc := &whiplash.SvcCore{Name: "osd.77", Type: whiplash.OSD, Host: "store77", Reporting: true}
+	for _, skew := range []int64{-70, 3600} {
+		before := time.Now().Unix()
+		sent := before + skew
+		if _, err := pingHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: sent, Svc: svc})); err != nil {
+			t.Fatal(err)
+		}
+		_, err := statHandler(clientUpdate(t, &whiplash.ClientUpdate{Time: sent, Svc: svc, Payload: json.RawMessage(`{}`)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now().Unix()
+		for _, handler := range []string{"ping", "stat"} {
+			if ts := lastseen.get(svc.Name, handler); ts < before || ts > after {
+				t.Errorf("skew %d: %s should be recorded at arrival, %d-%d, but is %d", skew, handler, before, after, ts)
+			}
+		}
+		if got := svcstat.get(svc.Name).State; got != whiplash.SvcUp {
+			t.Errorf("skew %d: %s should be up but is %s", skew, svc.Name, got)
+		}
+		if sunk != sent {
+			t.Errorf("skew %d: sinks should get the client's time %d but got %d", skew, sent, sunk)
+		}
+	}
+	// and it goes late on our schedule, not the client's
+	updateState(svc.Name, lastseen.get(svc.Name, "ping")+stalecheck.pingLate+1)
+	if got := svcstat.get(svc.Name).State; got != whiplash.SvcLate {
+		t.Errorf("%s should be late but is %s", svc.Name, got)
+	}
+}
+
+func TestOsdStatWeights(t *testing.T) {
+	defer freshStores()()
+	crushfile = "../../test_corpus/osdtree.json"
+	defer func() { crushfile = ""; crushmap.swap(nil) }()
+	if _, err := crushReload(); err != nil {
+		t.Fatal(err)
+	}
+	osd := &whiplash.SvcCore{Name: "osd.9901", Type: whiplash.OSD, Host: "cephstore9999", Reporting: true}
+	upd := &whiplash.ClientUpdate{Time: time.Now().Unix(), Svc: osd, Payload: json.RawMessage(`{"BytesUsed": 100}`)}
+	if _, err := statHandler(clientUpdate(t, upd)); err != nil {
+		t.Fatal(err)
+	}
+	if st := osdStat("osd.9901"); st == nil || st.Weight != 2 || st.Reweight != 0.85 || st.BytesUsed != 100 {
+		t.Errorf("osd.9901 should have its CRUSH weights but has %+v", st)
+	}
+	// a reload changes the weights without waiting for another stat
+	cm, _ := whiplash.CrushLoad(crushfile)
+	cm.OsdNames["osd.9901"].Reweight = 0.5
+	crushmap.swap(cm)
+	if st := osdStat("osd.9901"); st.Reweight != 0.5 {
+		t.Errorf("osd.9901 reweight should be 0.5 after reload but is %v", st.Reweight)
+	}
+	// and the stored stat is untouched
+	if st := svcdata.getOsd("osd.9901"); st.Weight != 0 || st.Reweight != 0 {
+		t.Errorf("stored stat should not carry weights: %+v", st)
+	}
+	// without a CRUSH map there are no weights to add
+	crushmap.swap(nil)
+	if st := osdStat("osd.9901"); st.Weight != 0 || st.BytesUsed != 100 {
+		t.Errorf("osd.9901 should have no weights without a CRUSH map: %+v", st)
+	}
+	if osdStat("osd.9999") != nil {
+		t.Errorf("osd with no stat should have no stat")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+// This file contains the web dashboard. It is a single static page,
+// compiled into the aggregator so there's nothing to install, and
+// with no external scripts or stylesheets so that it works on
+// management networks which can't reach the internet. The page polls
+// the JSON API for 'status cluster' and 'status tree' and draws:
+//
+//   * a heatmap of the CRUSH hierarchy, with each OSD coloured by how
+//     full it is, and OSDs which aren't reporting marked out
+//   * a table of every service, with its liveness state and the age
+//     of its last updates
+
+import (
+	"net/http"
+)
+
+// dashboardHandler serves the dashboard at the root of the HTTP
+// listener. Anything else not routed elsewhere is a 404.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>whiplash</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 1em; background: #fafafa; color: #222; }
+h1 { font-size: 18px; margin: 0 0 .5em 0; }
+h2 { font-size: 15px; margin: 1.5em 0 .5em 0; }
+#summary span { margin-right: 2em; }
+#updated { color: #777; }
+.err { color: #c00; font-weight: bold; }
+.bucket { border: 1px solid #ccc; border-radius: 3px; margin: 4px; padding: 3px 5px; display: inline-block; vertical-align: top; background: #fff; }
+.bucket > .label { font-size: 11px; color: #555; white-space: nowrap; }
+.bucket.host { padding: 2px 4px; }
+.osds { line-height: 0; }
+.osd { display: inline-block; width: 14px; height: 14px; margin: 1px; border: 1px solid rgba(0,0,0,.2); }
+.osd.down { background: repeating-linear-gradient(45deg, #999, #999 3px, #eee 3px, #eee 6px) !important; }
+#legend span { display: inline-block; width: 14px; height: 14px; vertical-align: middle; border: 1px solid rgba(0,0,0,.2); margin: 0 2px 0 10px; }
+table { border-collapse: collapse; background: #fff; }
+th, td { text-align: left; padding: 2px 10px; border-bottom: 1px solid #eee; }
+th { cursor: pointer; border-bottom: 1px solid #999; }
+tr.late td { color: #b60; }
+tr.down td { color: #c00; }
+tr.gone td { color: #999; }
+</style>
+</head>
+<body>
+<h1>whiplash</h1>
+<div id="summary"></div>
+<div id="updated"></div>
+
+<h2>Cluster</h2>
+<div id="legend">fill:
+<span style="background:hsl(120,70%,45%)"></span>0%
+<span style="background:hsl(60,70%,45%)"></span>50%
+<span style="background:hsl(0,70%,45%)"></span>100%
+<span class="down" style="background:#999"></span>not reporting
+</div>
+<div id="tree"></div>
+
+<h2>Services</h2>
+<table>
+<thead><tr>
+<th data-key="name">Service</th><th data-key="type">Type</th><th data-key="host">Host</th>
+<th data-key="version">Version</th><th data-key="state">State</th><th data-key="status">Status</th>
+<th data-key="ping">Last ping</th><th data-key="stat">Last stat</th>
+</tr></thead>
+<tbody id="svcs"></tbody>
+</table>
+
+<script>
+"use strict";
+var REFRESH = 10000;
+var svcTypes = {0: "mon", 1: "rgw", 2: "osd"};
+var sortKey = "name", sortRev = false, lastTree = null;
+
+function el(tag, cls, text) {
+	var e = document.createElement(tag);
+	if (cls) { e.className = cls; }
+	if (text !== undefined) { e.textContent = text; }
+	return e;
+}
+
+function humanBytes(b) {
+	var units = ["B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"], i = 0;
+	while (b >= 1024 && i < units.length - 1) { b /= 1024; i++; }
+	return (i === 0 ? b : b.toFixed(1)) + units[i];
+}
+
+function age(now, ts) {
+	if (!ts) { return "never"; }
+	var s = Math.max(0, now - ts);
+	if (s < 120) { return s + "s ago"; }
+	if (s < 7200) { return Math.floor(s / 60) + "m ago"; }
+	return Math.floor(s / 3600) + "h ago";
+}
+
+// fillColour runs from green when empty to red when full.
+function fillColour(ratio) {
+	ratio = Math.min(Math.max(ratio, 0), 1);
+	return "hsl(" + Math.round(120 * (1 - ratio)) + ",70%,45%)";
+}
+
+function svcNum(name) {
+	var i = name.lastIndexOf(".");
+	return [name.slice(0, i), parseInt(name.slice(i + 1), 10) || 0, name];
+}
+
+function svcCompare(a, b) {
+	var x = svcNum(a), y = svcNum(b);
+	if (x[0] !== y[0]) { return x[0] < y[0] ? -1 : 1; }
+	if (x[1] !== y[1]) { return x[1] - y[1]; }
+	return x[2] < y[2] ? -1 : x[2] > y[2] ? 1 : 0;
+}
+
+function drawBucket(now, b) {
+	var div = el("div", "bucket " + b.Type);
+	div.appendChild(el("div", "label", b.Type + " " + b.Name));
+	if (b.Osds && b.Osds.length) {
+		var osds = el("div", "osds");
+		b.Osds.forEach(function (o) {
+			var sq = el("span", "osd");
+			var tip = o.Svc.name;
+			if (o.Stat) {
+				sq.style.background = fillColour(o.Stat.FillRatio);
+				tip += "\n" + (o.Stat.FillRatio * 100).toFixed(1) + "% full (" +
+					humanBytes(o.Stat.BytesUsed) + " of " + humanBytes(o.Stat.BytesTotal) + ")";
+			}
+			if (!o.Svc.reporting) {
+				sq.className += " down";
+				tip += "\nnot reporting";
+			}
+			if (o.Svc.state && o.Svc.state !== "up") {
+				tip += "\n" + o.Svc.state;
+			}
+			tip += "\nlast stat " + age(now, o.LastStat);
+			sq.title = tip;
+			osds.appendChild(sq);
+		});
+		div.appendChild(osds);
+	}
+	(b.Buckets || []).forEach(function (c) { div.appendChild(drawBucket(now, c)); });
+	return div;
+}
+
+function svcRow(now, s) {
+	var v = s.Svc;
+	return {
+		name: v.name, type: svcTypes[v.type] || "unknown", host: v.host, version: v.version,
+		state: v.state || "", status: v.reporting ? "ok" : "NOT REPORTING",
+		ping: s.LastPing, stat: s.LastStat,
+		cls: ({late: "late", stale: "down", gone: "gone"})[v.state] || (v.reporting ? "" : "down")
+	};
+}
+
+function drawSvcs(tr) {
+	var rows = (tr.Svcs || []).map(function (s) { return svcRow(tr.Time, s); });
+	rows.sort(function (a, b) {
+		var c;
+		if (sortKey === "name") {
+			c = svcCompare(a.name, b.name);
+		} else if (sortKey === "ping" || sortKey === "stat") {
+			c = b[sortKey] - a[sortKey];
+		} else {
+			c = a[sortKey] < b[sortKey] ? -1 : a[sortKey] > b[sortKey] ? 1 : svcCompare(a.name, b.name);
+		}
+		return sortRev ? -c : c;
+	});
+	var tbody = document.getElementById("svcs");
+	tbody.textContent = "";
+	rows.forEach(function (r) {
+		var tr2 = el("tr", r.cls);
+		[r.name, r.type, r.host, r.version, r.state, r.status, age(tr.Time, r.ping), age(tr.Time, r.stat)].forEach(function (t) {
+			tr2.appendChild(el("td", "", t));
+		});
+		tbody.appendChild(tr2);
+	});
+}
+
+function drawTree(tr) {
+	var div = document.getElementById("tree");
+	div.textContent = "";
+	if (!tr.Roots || !tr.Roots.length) {
+		div.appendChild(el("div", "err", "no CRUSH map loaded"));
+	}
+	(tr.Roots || []).forEach(function (b) { div.appendChild(drawBucket(tr.Time, b)); });
+	drawSvcs(tr);
+}
+
+function drawSummary(cr) {
+	var div = document.getElementById("summary");
+	div.textContent = "";
+	var total = cr.BytesTotal;
+	[
+		"OSDs: " + cr.OsdsReporting + "/" + cr.Osds + " reporting",
+		"MONs: " + cr.MonsReporting + "/" + cr.Mons + " reporting",
+		"RGWs: " + cr.RgwsReporting + "/" + cr.Rgws + " reporting",
+		"Capacity: " + humanBytes(cr.BytesUsed) + " of " + humanBytes(total) +
+			(total ? " (" + (100 * cr.BytesUsed / total).toFixed(1) + "%)" : "")
+	].forEach(function (t) {
+		var s = el("span", "", t);
+		var m = /^\w+: (\d+)\/(\d+)/.exec(t);
+		if (m && m[1] !== m[2]) { s.className = "err"; }
+		div.appendChild(s);
+	});
+}
+
+function fetchJSON(path, cb) {
+	var x = new XMLHttpRequest();
+	x.open("GET", path);
+	x.onload = function () {
+		var resp;
+		try { resp = JSON.parse(x.responseText); } catch (e) { return failed(path + ": bad response"); }
+		if (resp.code !== 200) { return failed(path + ": " + resp.data); }
+		cb(resp.data);
+	};
+	x.onerror = function () { failed(path + ": aggregator unreachable"); };
+	x.send();
+}
+
+function failed(msg) {
+	var u = document.getElementById("updated");
+	u.className = "err";
+	u.textContent = msg + " (retrying)";
+}
+
+function refresh() {
+	fetchJSON("api/v1/status/cluster", drawSummary);
+	fetchJSON("api/v1/status/tree", function (tr) {
+		lastTree = tr;
+		drawTree(tr);
+		var u = document.getElementById("updated");
+		u.className = "";
+		u.textContent = "updated " + new Date(tr.Time * 1000).toLocaleTimeString();
+	});
+}
+
+Array.prototype.forEach.call(document.querySelectorAll("th"), function (th) {
+	th.onclick = function () {
+		var k = th.getAttribute("data-key");
+		sortRev = (k === sortKey) ? !sortRev : false;
+		sortKey = k;
+		if (lastTree) { drawSvcs(lastTree); }
+	};
+});
+refresh();
+setInterval(refresh, REFRESH);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,130 @@
+package main
+
+// This file contains the Graphite sink, which forwards stats to a
+// carbon daemon using the plaintext protocol: one
+// "<path> <value> <timestamp>" line per metric.
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// graphitePrefix is the default first component of metric paths.
+const graphitePrefix = "whiplash"
+
+// graphiteSink is a sink which writes to carbon.
+type graphiteSink struct {
+	*lineSink
+	prefix string
+}
+
+// newGraphiteSink returns a graphiteSink configured by `conf`, and
+// starts its writer.
+func newGraphiteSink(conf *whiplash.WLGraphiteConfig) *graphiteSink {
+	g := &graphiteSink{
+		lineSink: newLineSink("graphite", &carbonWriter{addr: conf.Addr}, conf.WLSinkBufConfig),
+		prefix: conf.Prefix,
+	}
+	if g.prefix == "" {
+		g.prefix = graphitePrefix
+	}
+	return g
+}
+
+// send formats a stat update as carbon lines and queues them.
+func (g *graphiteSink) send(svc *whiplash.SvcCore, t int64, fields map[string]float64) {
+	host, rack, row := crushmap.locate(svc)
+	base := strings.Join([]string{
+		g.prefix,
+		graphiteComponent(row),
+		graphiteComponent(rack),
+		graphiteComponent(host),
+		graphiteComponent(svc.Name),
+	}, ".")
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ts := strconv.FormatInt(t, 10)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = base + "." + graphiteMetric(name) + " " +
+			strconv.FormatFloat(fields[name], 'f', -1, 64) + " " + ts + "\n"
+	}
+	g.enqueue(lines)
+}
+
+// carbonWriter writes lines to carbon over a persistent TCP
+// connection.
+type carbonWriter struct {
+	addr string
+	conn net.Conn
+}
+
+// write sends lines to carbon, connecting first if needed. On error
+// the connection is dropped, to be reestablished on the next try, and
+// any lines which were fully written are reported so they aren't sent
+// twice. A line which was cut off is sent again whole; carbon throws
+// away the fragment when the connection closes.
+func (c *carbonWriter) write(lines []string) error {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	n, err := c.conn.Write([]byte(strings.Join(lines, "")))
+	if err == nil {
+		return nil
+	}
+	c.close()
+	sent := 0
+	for _, line := range lines {
+		if n < len(line) {
+			break
+		}
+		n -= len(line)
+		sent++
+	}
+	return partialErr(sent, err)
+}
+
+func (c *carbonWriter) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// graphiteComponent makes a string safe to use as a single component
+// of a metric path. Empty strings become "unknown".
+func graphiteComponent(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' || r == '/' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// graphiteMetric makes a field name safe to use as the tail of a
+// metric path. Dots are kept, since counter names are hierarchical.
+func graphiteMetric(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '/' {
+			return '_'
+		}
+		return r
+	}, s)
+}
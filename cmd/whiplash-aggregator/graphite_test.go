@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// fakeCarbon accepts connections on `l` and sends every line it
+// receives down the returned channel.
+func fakeCarbon(l net.Listener) chan string {
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}(conn)
+		}
+	}()
+	return lines
+}
+
+// recvLines reads `n` lines from `lines`, or fails the test.
+func recvLines(t *testing.T, lines chan string, n int) []string {
+	var got []string
+	for len(got) < n {
+		select {
+		case l := <-lines:
+			got = append(got, l)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for carbon lines; got %v", got)
+		}
+	}
+	return got
+}
+
+func TestGraphiteSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := fakeCarbon(l)
+	g := newGraphiteSink(&whiplash.WLGraphiteConfig{Addr: l.Addr().String(), WLSinkBufConfig: whiplash.WLSinkBufConfig{FlushInterval: 10}})
+	defer g.close()
+
+	svc := &whiplash.SvcCore{Name: "osd.1", Type: whiplash.OSD, Host: "node1"}
+	g.send(svc, 1000, statFields(&whiplash.OsdStat{BytesUsed: 100, FillRatio: 0.25, Counters: map[string]float64{"osd.op_r": 2.5}}))
+	got := strings.Join(recvLines(t, lines, len(statFields(&whiplash.OsdStat{}))+1), "\n")
+	for _, want := range []string{
+		"whiplash.unknown.unknown.node1.osd_1.bytes_used 100 1000",
+		"whiplash.unknown.unknown.node1.osd_1.fill_ratio 0.25 1000",
+		"whiplash.unknown.unknown.node1.osd_1.counters.osd.op_r 2.5 1000",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing line %q; got:\n%s", want, got)
+		}
+	}
+}
+
+func TestGraphiteReconnect(t *testing.T) {
+	// find a free port, and leave nothing listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	g := newGraphiteSink(&whiplash.WLGraphiteConfig{Addr: addr, WLSinkBufConfig: whiplash.WLSinkBufConfig{FlushInterval: 10, MaxBackoff: 1}})
+	defer g.close()
+	g.enqueue([]string{"a.b 1 1000\n", "a.c 2 1000\n"})
+	// let a few connection attempts fail, then bring carbon up
+	time.Sleep(200 * time.Millisecond)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("couldn't relisten on %s: %v", addr, err)
+	}
+	defer l.Close()
+	got := recvLines(t, fakeCarbon(l), 2)
+	if got[0] != "a.b 1 1000" || got[1] != "a.c 2 1000" {
+		t.Errorf("lines lost or reordered across reconnect: %v", got)
+	}
+}
+
+// shortConn is a net.Conn which fails any write longer than `n`
+// bytes, after writing the first `n`.
+type shortConn struct {
+	net.Conn
+	n int
+}
+
+func (sc *shortConn) Write(b []byte) (int, error) {
+	if len(b) > sc.n {
+		return sc.n, fmt.Errorf("connection reset")
+	}
+	return len(b), nil
+}
+
+func (sc *shortConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (sc *shortConn) Close() error { return nil }
+
+// A write which fails partway through should report the lines which
+// got out whole, so only the rest are sent again.
+func TestCarbonPartial(t *testing.T) {
+	lines := []string{"a.b 1 1000\n", "a.c 2 1000\n", "a.d 3 1000\n"}
+	tests := []struct {
+		n    int
+		sent int
+	}{
+		// cut off in the middle of the second line
+		{len(lines[0]) + 4, 1},
+		// exactly at the end of the second line
+		{len(lines[0]) + len(lines[1]), 2},
+	}
+	for _, tt := range tests {
+		c := &carbonWriter{conn: &shortConn{n: tt.n}}
+		err := c.write(lines)
+		pw, ok := err.(*partialWrite)
+		if !ok || pw.sent != tt.sent {
+			t.Errorf("%d bytes written: expected a partial write of %d lines; got %v", tt.n, tt.sent, err)
+		}
+		if c.conn != nil {
+			t.Errorf("%d bytes written: connection should have been dropped", tt.n)
+		}
+	}
+	// nothing whole got out, so it's a plain error
+	c := &carbonWriter{conn: &shortConn{n: 4}}
+	if err := c.write(lines); err == nil {
+		t.Errorf("expected an error")
+	} else if _, ok := err.(*partialWrite); ok {
+		t.Errorf("expected a plain error; got %v", err)
+	}
+}
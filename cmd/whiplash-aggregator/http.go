@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// apiPrefix is where the JSON API lives. Paths under it map onto
+// query commands: /api/v1/status/rack/r1 is 'status rack r1'.
+const apiPrefix = "/api/v1/"
+
+// apiWrites lists the query commands which change the aggregator's
+// state, and so must be POSTed rather than fetched with GET.
+var apiWrites = map[string]bool{
+	"crushreload": true,
+}
+
+// httpMux returns the routing for whiplash-aggregator's HTTP
+// listener.
+func httpMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc(apiPrefix, apiHandler)
+	mux.HandleFunc("/", dashboardHandler)
+	return mux
+}
+
+// httpServe runs the HTTP listener on `addr`. It only returns if the
+// listener dies.
+func httpServe(addr string) {
+	log.Println("http listener starting on", addr)
+	err := http.ListenAndServe(addr, httpMux())
+	log.Println("http listener has shut down:", err)
+}
+
+// apiHandler serves the JSON API. It dispatches through the same
+// handlers as the query petrel instance, and replies with the same
+// QueryResponse envelope. The HTTP status is the response's Code.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	var args [][]byte
+	for _, chunk := range strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/") {
+		if chunk != "" {
+			args = append(args, []byte(chunk))
+		}
+	}
+	if len(args) == 0 {
+		apiReply(w, apiErr(&whiplash.QueryResponse{}, 404, "no command given"))
+		return
+	}
+	cmd := string(args[0])
+	want := "GET"
+	if apiWrites[cmd] {
+		want = "POST"
+	}
+	if r.Method != want && !(want == "GET" && r.Method == "HEAD") {
+		w.Header().Set("Allow", want)
+		resp := &whiplash.QueryResponse{Cmd: cmd}
+		apiReply(w, apiErr(resp, 405, "method must be "+want))
+		return
+	}
+	reply, err := queryDispatch(cmd, args[1:])
+	if err != nil {
+		log.Println("api", r.URL.Path, "failed:", err)
+		reply = apiErr(&whiplash.QueryResponse{Cmd: cmd}, 500, err.Error())
+	}
+	apiReply(w, reply)
+}
+
+// apiErr returns a marshalled error response.
+func apiErr(resp *whiplash.QueryResponse, code int, msg string) []byte {
+	reply, _ := qhErr(resp, code, msg)
+	return reply
+}
+
+// apiReply writes a marshalled QueryResponse, with its Code as the
+// HTTP status.
+func apiReply(w http.ResponseWriter, reply []byte) {
+	resp := &whiplash.QueryResponse{}
+	if err := json.Unmarshal(reply, resp); err != nil || resp.Code == 0 {
+		resp.Code = 500
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.Code)
+	w.Write(reply)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestAPI(t *testing.T) {
+	svcstat.set("osd.2", &whiplash.SvcCore{Name: "osd.2", Type: whiplash.OSD, Host: "node1", Reporting: true})
+	svcdata.setOsd("osd.2", &whiplash.OsdStat{BytesUsed: 100})
+	ts := httptest.NewServer(httpMux())
+	defer ts.Close()
+
+	tests := []struct {
+		method, path string
+		code int
+		cmd, subcmd string
+	}{
+		{"GET", "/api/v1/status/cluster", 200, "status", "cluster"},
+		{"GET", "/api/v1/status/osd/osd.2/", 200, "status", "osd"},
+		{"HEAD", "/api/v1/status/cluster", 200, "", ""},
+		{"GET", "/api/v1/status/osd/999", 404, "status", "osd"},
+		{"GET", "/api/v1/status/rack", 400, "status", "rack"},
+		{"GET", "/api/v1/status", 400, "status", ""},
+		{"GET", "/api/v1/nosuch/thing", 404, "nosuch", "thing"},
+		{"GET", "/api/v1/", 404, "", ""},
+		{"POST", "/api/v1/status/cluster", 405, "status", ""},
+		{"GET", "/api/v1/crushreload", 405, "crushreload", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, ts.URL+test.path, nil)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.method, test.path, err)
+		}
+		if r.StatusCode != test.code {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.path, test.code, r.StatusCode)
+		}
+		if test.method == "HEAD" {
+			r.Body.Close()
+			continue
+		}
+		resp := &whiplash.QueryResponse{}
+		err = json.NewDecoder(r.Body).Decode(resp)
+		r.Body.Close()
+		if err != nil {
+			t.Errorf("%s %s: bad envelope: %v", test.method, test.path, err)
+			continue
+		}
+		if resp.Code != test.code || resp.Cmd != test.cmd || resp.Subcmd != test.subcmd {
+			t.Errorf("%s %s: expected %d %s %s, got %d %s %s", test.method, test.path,
+				test.code, test.cmd, test.subcmd, resp.Code, resp.Cmd, resp.Subcmd)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	ts := httptest.NewServer(httpMux())
+	defer ts.Close()
+	r, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if r.StatusCode != 200 || !strings.HasPrefix(r.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("bad dashboard response: %d %s", r.StatusCode, r.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(page), "api/v1/status/tree") {
+		t.Errorf("dashboard doesn't poll the tree report")
+	}
+	// everything has to come from the aggregator
+	if strings.Contains(string(page), "http://") || strings.Contains(string(page), "https://") || strings.Contains(string(page), "//cdn") {
+		t.Errorf("dashboard references external resources")
+	}
+	r, err = http.Get(ts.URL + "/nosuch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != 404 {
+		t.Errorf("expected 404 for unrouted path, got %d", r.StatusCode)
+	}
+}
+
+func TestStatusTree(t *testing.T) {
+	crushfile = "../../test_corpus/osdtree.json"
+	defer func() { crushfile = ""; crushmap.swap(nil) }()
+	if _, err := crushReload(); err != nil {
+		t.Fatal(err)
+	}
+	svcstat.set("osd.9901", &whiplash.SvcCore{Name: "osd.9901", Type: whiplash.OSD, Host: "cephstore9999", Reporting: true})
+	svcdata.setOsd("osd.9901", &whiplash.OsdStat{FillRatio: 0.5})
+	tr := statusTree()
+	if len(tr.Roots) != 1 || tr.Roots[0].Name != "default" {
+		t.Fatalf("expected one root 'default', got %v", tr.Roots)
+	}
+	// default > irv > irv-n > irv-n1 > cephstore9999
+	host := tr.Roots[0].Buckets[0].Buckets[1].Buckets[1].Buckets[0]
+	if host.Name != "cephstore9999" || len(host.Osds) != 3 {
+		t.Fatalf("expected cephstore9999 with 3 osds, got %s with %d", host.Name, len(host.Osds))
+	}
+	for _, or := range host.Osds {
+		switch or.Svc.Name {
+		case "osd.9901":
+			if !or.Svc.Reporting || or.Stat == nil || or.Stat.FillRatio != 0.5 {
+				t.Errorf("osd.9901 should be reporting, 50%% full: %+v", or)
+			}
+		default:
+			if or.Svc.Reporting || or.Stat != nil || or.Svc.Host != "cephstore9999" {
+				t.Errorf("%s has never reported: %+v", or.Svc.Name, or)
+			}
+		}
+	}
+	found := false
+	for _, sr := range tr.Svcs {
+		if sr.Svc.Name == "osd.9901" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("osd.9901 missing from services")
+	}
+}
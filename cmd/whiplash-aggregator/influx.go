@@ -0,0 +1,195 @@
+package main
+
+// This file contains the InfluxDB sink, which forwards stats as
+// InfluxDB line protocol, over HTTP or UDP. Each stat update becomes
+// one point, in the measurement "whiplash_<type>", tagged with the
+// service's host, name, type, and version.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// influxUDPPayload is the largest datagram we'll send. Batches are
+// split across as many datagrams as needed to stay under it.
+const influxUDPPayload = 1400
+
+// influxSink is a sink which writes to InfluxDB.
+type influxSink struct {
+	*lineSink
+}
+
+// newInfluxSink returns an influxSink configured by `conf`, and
+// starts its writer.
+func newInfluxSink(conf *whiplash.WLInfluxConfig) (*influxSink, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	var w lineWriter
+	switch u.Scheme {
+	case "http", "https":
+		w = &influxHTTPWriter{url: conf.URL, client: &http.Client{Timeout: sinkTimeout}}
+	case "udp":
+		w = &influxUDPWriter{addr: u.Host}
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB URL scheme %q", u.Scheme)
+	}
+	return &influxSink{newLineSink("influxdb", w, conf.WLSinkBufConfig)}, nil
+}
+
+// send formats a stat update as a point and queues it.
+func (i *influxSink) send(svc *whiplash.SvcCore, t int64, fields map[string]float64) {
+	if line := influxLine(svc, t, fields); line != "" {
+		i.enqueue([]string{line})
+	}
+}
+
+// influxLine returns a stat update in line protocol, or the empty
+// string if there are no fields. Tags and fields are sorted by key,
+// as InfluxDB prefers.
+func influxLine(svc *whiplash.SvcCore, t int64, fields map[string]float64) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	typ := whiplash.SvcTypeName(svc.Type)
+	b := &bytes.Buffer{}
+	b.WriteString(influxEscape("whiplash_"+typ, ", "))
+	// tags with empty values aren't allowed
+	for _, tag := range [][2]string{
+		{"host", svc.Host},
+		{"svc", svc.Name},
+		{"type", typ},
+		{"version", svc.Version},
+	} {
+		if tag[1] != "" {
+			b.WriteString("," + tag[0] + "=" + influxEscape(tag[1], ",= "))
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxEscape(name, ",= ") + "=" + strconv.FormatFloat(fields[name], 'f', -1, 64))
+	}
+	b.WriteString(" " + strconv.FormatInt(t*int64(time.Second), 10) + "\n")
+	return b.String()
+}
+
+// influxEscape backslash-escapes every character of `chars` in `s`.
+func influxEscape(s, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+	b := &bytes.Buffer{}
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// influxHTTPWriter POSTs batches to an InfluxDB write endpoint.
+type influxHTTPWriter struct {
+	url string
+	client *http.Client
+}
+
+// write sends lines as a single request. Server errors are retried;
+// client errors mean InfluxDB rejected the points, which retrying
+// won't fix, so those batches are logged and dropped.
+func (h *influxHTTPWriter) write(lines []string) error {
+	resp, err := h.client.Post(h.url, "text/plain; charset=utf-8", strings.NewReader(strings.Join(lines, "")))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 4 {
+		log.Printf("influxdb rejected %d points: %s: %s", len(lines), resp.Status, bytes.TrimSpace(msg))
+		return nil
+	}
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (h *influxHTTPWriter) close() {}
+
+// influxUDPWriter sends batches to an InfluxDB UDP listener.
+type influxUDPWriter struct {
+	addr string
+	conn net.Conn
+}
+
+// write packs lines into as few datagrams as it can. A single line
+// larger than influxUDPPayload is sent on its own. If a datagram
+// fails after others have been sent, the error is a *partialWrite.
+func (u *influxUDPWriter) write(lines []string) error {
+	if u.conn == nil {
+		conn, err := net.DialTimeout("udp", u.addr, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		u.conn = conn
+	}
+	var pkt []byte
+	// start is the index of the first line in pkt
+	start := 0
+	for i, line := range lines {
+		if len(pkt) > 0 && len(pkt)+len(line) > influxUDPPayload {
+			if err := u.send(pkt); err != nil {
+				return partialErr(start, err)
+			}
+			pkt = pkt[:0]
+			start = i
+		}
+		pkt = append(pkt, line...)
+		if i == len(lines)-1 {
+			if err := u.send(pkt); err != nil {
+				return partialErr(start, err)
+			}
+		}
+	}
+	return nil
+}
+
+// send writes a single datagram.
+func (u *influxUDPWriter) send(pkt []byte) error {
+	u.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	_, err := u.conn.Write(pkt)
+	if err != nil {
+		u.close()
+	}
+	return err
+}
+
+func (u *influxUDPWriter) close() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestInfluxLine(t *testing.T) {
+	svc := &whiplash.SvcCore{Name: "osd.1", Type: whiplash.OSD, Host: "node 1", Version: "0.94.5"}
+	fields := map[string]float64{"fill_ratio": 0.25, "bytes_used": 100, "counters.a,b": 1}
+	got := influxLine(svc, 1000, fields)
+	want := `whiplash_osd,host=node\ 1,svc=osd.1,type=osd,version=0.94.5 bytes_used=100,counters.a\,b=1,fill_ratio=0.25 1000000000000` + "\n"
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	// empty tags are left out
+	svc.Version = ""
+	if got := influxLine(svc, 1000, fields); strings.Contains(got, "version=") {
+		t.Errorf("empty tag should be omitted: %q", got)
+	}
+	// and a point with no fields is no point at all
+	if got := influxLine(svc, 1000, nil); got != "" {
+		t.Errorf("expected no line, got %q", got)
+	}
+}
+
+func TestInfluxHTTP(t *testing.T) {
+	bodies := make(chan string, 10)
+	status := http.StatusServiceUnavailable
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if status != http.StatusNoContent {
+			// first request fails, so the batch should come back
+			status = http.StatusNoContent
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- r.URL.RawQuery + " " + string(b)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	is, err := newInfluxSink(&whiplash.WLInfluxConfig{
+		URL: ts.URL + "/write?db=ceph",
+		WLSinkBufConfig: whiplash.WLSinkBufConfig{FlushInterval: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.close()
+	is.send(&whiplash.SvcCore{Name: "mon.a", Type: whiplash.MON, Host: "node1"}, 5, map[string]float64{"rank": 0})
+	select {
+	case b := <-bodies:
+		if b != "db=ceph whiplash_mon,host=node1,svc=mon.a,type=mon rank=0 5000000000\n" {
+			t.Errorf("bad request %q", b)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for influxdb write")
+	}
+}
+
+func TestInfluxUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	w := &influxUDPWriter{addr: pc.LocalAddr().String()}
+	defer w.close()
+	// three lines which won't fit in one datagram, but two will
+	line := strings.Repeat("x", influxUDPPayload/3) + "\n"
+	err = w.write([]string{line, line, line})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var sizes []int
+	for i := 0; i < 2; i++ {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, n)
+	}
+	if sizes[0] != len(line)*2 || sizes[1] != len(line) {
+		t.Errorf("expected datagrams of %d and %d bytes; got %v", len(line)*2, len(line), sizes)
+	}
+}
+
+// failConn is a net.Conn whose writes start failing after `ok` of
+// them have succeeded.
+type failConn struct {
+	net.Conn
+	ok int
+	writes [][]byte
+}
+
+func (fc *failConn) Write(b []byte) (int, error) {
+	if len(fc.writes) >= fc.ok {
+		return 0, fmt.Errorf("network is down")
+	}
+	fc.writes = append(fc.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (fc *failConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (fc *failConn) Close() error { return nil }
+
+// A datagram which fails after others went out should report how many
+// lines were sent, so they aren't sent again.
+func TestInfluxUDPPartial(t *testing.T) {
+	line := strings.Repeat("x", influxUDPPayload/3) + "\n"
+	lines := []string{line, line, line, line, line}
+	// the first datagram, with two lines, goes; the second doesn't
+	fc := &failConn{ok: 1}
+	w := &influxUDPWriter{conn: fc}
+	err := w.write(lines)
+	pw, ok := err.(*partialWrite)
+	if !ok || pw.sent != 2 {
+		t.Fatalf("expected a partial write of 2 lines; got %v", err)
+	}
+	if len(fc.writes) != 1 || len(fc.writes[0]) != len(line)*2 {
+		t.Errorf("expected one datagram of 2 lines; got %d", len(fc.writes))
+	}
+	// and one which fails straight away is a plain error
+	w = &influxUDPWriter{conn: &failConn{}}
+	err = w.write(lines)
+	if _, ok := err.(*partialWrite); ok || err == nil {
+		t.Errorf("expected a plain error; got %v", err)
+	}
+	// as is a failure of the last datagram, if it's the only one
+	w = &influxUDPWriter{conn: &failConn{}}
+	if err = w.write([]string{"a\n"}); err == nil {
+		t.Errorf("expected an error")
+	} else if _, ok := err.(*partialWrite); ok {
+		t.Errorf("expected a plain error; got %v", err)
+	}
+}
+
+// newInfluxSink should refuse URLs it can't write to.
+func TestInfluxBadURL(t *testing.T) {
+	_, err := newInfluxSink(&whiplash.WLInfluxConfig{URL: "tcp://influx:8086"})
+	if err == nil {
+		t.Error("tcp URL should have been refused")
+	}
+}
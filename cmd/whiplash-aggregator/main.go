@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"firepear.net/petrel"
 	"github.com/sboyettedh/whiplash"
@@ -15,14 +17,21 @@ var (
 
 	// storage for current status of all reporting services
 	svcstat = &svcStatus{m: make(map[string]*whiplash.SvcCore)}
-	// host-to-service mapping
-	host2svcs = &host2Svcs{m: make(map[string][]string)}
-	// per-service update timestamps
+	// service-to-host index, in both directions
+	svchosts = &svcHostIndex{h2s: make(map[string]map[string]bool), s2h: make(map[string]string)}
+	// the CRUSH map, for locating hosts and OSDs
+	crushmap = &crushMap{}
+	// where to load the CRUSH map from; empty means run ceph
+	crushfile string
+	// per-service times, by our clock, when each kind of update arrived
 	lastseen = &svcUpdates{m: make(map[string]map[string]int64)}
 
-	// osd status info
-	// NOT IN USE YET
-	// osdstats = map[string]*whiplash.OsdStat{}
+	// per-service stat data
+	svcdata = &svcStatData{
+		osd: make(map[string]*whiplash.OsdStat),
+		mon: make(map[string]*whiplash.MonStat),
+		rgw: make(map[string]*whiplash.RgwStat),
+	}
 
 	// pre-rolled messages
 	success = []byte("ok")
@@ -46,36 +55,253 @@ func (s *svcStatus) set(svcname string, stat *whiplash.SvcCore) {
 	s.m[svcname] = stat
 	s.Unlock()
 }
+// swap replaces the entry for svcname with `svc`, but only if it is
+// still `old`, so that an update which arrives mid-sweep isn't lost.
+func (s *svcStatus) swap(svcname string, old, svc *whiplash.SvcCore) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.m[svcname] != old {
+		return false
+	}
+	s.m[svcname] = svc
+	return true
+}
+func (s *svcStatus) remove(svcname string) {
+	s.Lock()
+	delete(s.m, svcname)
+	s.Unlock()
+}
 func (s *svcStatus) get(svcname string) *whiplash.SvcCore {
 	s.RLock()
 	defer s.RUnlock()
 	return s.m[svcname]
 }
+func (s *svcStatus) getAll() []*whiplash.SvcCore {
+	s.RLock()
+	defer s.RUnlock()
+	svcs := make([]*whiplash.SvcCore, 0, len(s.m))
+	for _, svc := range s.m {
+		svcs = append(svcs, svc)
+	}
+	return svcs
+}
 
-type host2Svcs struct {
+type svcStatData struct {
 	sync.RWMutex
-	m map[string][]string
+	osd map[string]*whiplash.OsdStat
+	mon map[string]*whiplash.MonStat
+	rgw map[string]*whiplash.RgwStat
 }
-func (h2s *host2Svcs) set(hostname, svcname string) {
-	h2s.Lock()
-	_, ok := h2s.m[hostname]
-	if !ok {
-		h2s.m[hostname] = []string{}
+func (sd *svcStatData) setOsd(svcname string, stat *whiplash.OsdStat) {
+	sd.Lock()
+	sd.osd[svcname] = stat
+	sd.Unlock()
+}
+func (sd *svcStatData) getOsd(svcname string) *whiplash.OsdStat {
+	sd.RLock()
+	defer sd.RUnlock()
+	return sd.osd[svcname]
+}
+func (sd *svcStatData) setMon(svcname string, stat *whiplash.MonStat) {
+	sd.Lock()
+	sd.mon[svcname] = stat
+	sd.Unlock()
+}
+func (sd *svcStatData) getMon(svcname string) *whiplash.MonStat {
+	sd.RLock()
+	defer sd.RUnlock()
+	return sd.mon[svcname]
+}
+func (sd *svcStatData) setRgw(svcname string, stat *whiplash.RgwStat) {
+	sd.Lock()
+	sd.rgw[svcname] = stat
+	sd.Unlock()
+}
+func (sd *svcStatData) getRgw(svcname string) *whiplash.RgwStat {
+	sd.RLock()
+	defer sd.RUnlock()
+	return sd.rgw[svcname]
+}
+func (sd *svcStatData) remove(svcname string) {
+	sd.Lock()
+	delete(sd.osd, svcname)
+	delete(sd.mon, svcname)
+	delete(sd.rgw, svcname)
+	sd.Unlock()
+}
+
+type svcHostIndex struct {
+	sync.RWMutex
+	// h2s maps hosts to the set of services on them
+	h2s map[string]map[string]bool
+	// s2h maps services to the host they're on
+	s2h map[string]string
+}
+// set records that svcname is on hostname. If it was on another host
+// before, it is moved, and the old host is dropped if that leaves it
+// empty.
+func (si *svcHostIndex) set(hostname, svcname string) {
+	si.Lock()
+	defer si.Unlock()
+	old, ok := si.s2h[svcname]
+	if ok && old == hostname {
+		return
+	}
+	if ok {
+		si.unlink(old, svcname)
+	}
+	if si.h2s[hostname] == nil {
+		si.h2s[hostname] = map[string]bool{}
+	}
+	si.h2s[hostname][svcname] = true
+	si.s2h[svcname] = hostname
+}
+// remove drops svcname from the index.
+func (si *svcHostIndex) remove(svcname string) {
+	si.Lock()
+	defer si.Unlock()
+	if host, ok := si.s2h[svcname]; ok {
+		si.unlink(host, svcname)
+		delete(si.s2h, svcname)
 	}
-	h2s.m[hostname] = append(h2s.m[hostname], svcname)
-	h2s.Unlock()
 }
-func (h2s *host2Svcs) getSvcs(hostname string) []string {
-	h2s.RLock()
-	defer h2s.RUnlock()
-	return h2s.m[hostname]
+// unlink removes svcname from hostname's set. The caller must hold
+// the lock.
+func (si *svcHostIndex) unlink(hostname, svcname string) {
+	delete(si.h2s[hostname], svcname)
+	if len(si.h2s[hostname]) == 0 {
+		delete(si.h2s, hostname)
+	}
+}
+func (si *svcHostIndex) getSvcs(hostname string) []string {
+	si.RLock()
+	defer si.RUnlock()
+	svcs := make([]string, 0, len(si.h2s[hostname]))
+	for svc := range si.h2s[hostname] {
+		svcs = append(svcs, svc)
+	}
+	sort.Slice(svcs, func(i, j int) bool { return svcLess(svcs[i], svcs[j]) })
+	return svcs
 }
-func (h2s *host2Svcs) hostexists(hostname string) bool {
-	h2s.RLock()
-	defer h2s.RUnlock()
-	_, ok := h2s.m[hostname]
+func (si *svcHostIndex) getHost(svcname string) (string, bool) {
+	si.RLock()
+	defer si.RUnlock()
+	host, ok := si.s2h[svcname]
+	return host, ok
+}
+func (si *svcHostIndex) hostexists(hostname string) bool {
+	si.RLock()
+	defer si.RUnlock()
+	_, ok := si.h2s[hostname]
 	return ok
 }
+func (si *svcHostIndex) getHosts() []string {
+	si.RLock()
+	defer si.RUnlock()
+	hosts := make([]string, 0, len(si.h2s))
+	for host := range si.h2s {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+type crushMap struct {
+	sync.RWMutex
+	cm *whiplash.CrushMap
+}
+func (c *crushMap) swap(cm *whiplash.CrushMap) *whiplash.CrushMap {
+	c.Lock()
+	defer c.Unlock()
+	old := c.cm
+	c.cm = cm
+	return old
+}
+func (c *crushMap) get() *whiplash.CrushMap {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cm
+}
+// weigh returns a copy of stat with the OSD's weights filled in from
+// the current CRUSH map. Stats are stored as clients sent them, so a
+// CRUSH reload shows up in every report right away instead of after
+// the OSD's next stat. stat is returned as-is if it is nil or the OSD
+// isn't in the map.
+func (c *crushMap) weigh(svcname string, stat *whiplash.OsdStat) *whiplash.OsdStat {
+	c.RLock()
+	defer c.RUnlock()
+	if stat == nil || c.cm == nil {
+		return stat
+	}
+	co, ok := c.cm.OsdNames[svcname]
+	if !ok {
+		return stat
+	}
+	weighed := *stat
+	weighed.SetCrush(co)
+	return &weighed
+}
+func (c *crushMap) getHosts(rackname string) ([]string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cm == nil {
+		return nil, false
+	}
+	rack, ok := c.cm.BucketNames[rackname]
+	if !ok || rack.Type != "rack" {
+		return nil, false
+	}
+	hosts := []string{}
+	for _, host := range rack.Descendants("host") {
+		hosts = append(hosts, host.Name)
+	}
+	return hosts, true
+}
+// location returns the names of the CRUSH buckets containing svc,
+// keyed by bucket type. OSDs are in the map themselves; everything
+// else is located by the host it runs on.
+func (c *crushMap) location(svc *whiplash.SvcCore) map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cm == nil {
+		return nil
+	}
+	if co, ok := c.cm.OsdNames[svc.Name]; ok && co.Parent != nil {
+		return co.Location()
+	}
+	hb, ok := c.cm.BucketNames[svc.Host]
+	if !ok {
+		return nil
+	}
+	loc := map[string]string{}
+	for b := hb; b != nil; b = b.Parent {
+		loc[b.Type] = b.Name
+	}
+	return loc
+}
+func (c *crushMap) locate(svc *whiplash.SvcCore) (host, rack, row string) {
+	loc := c.location(svc)
+	host = svc.Host
+	if h, ok := loc["host"]; ok {
+		host = h
+	}
+	return host, loc["rack"], loc["row"]
+}
+func (c *crushMap) getRacks() []string {
+	c.RLock()
+	defer c.RUnlock()
+	racks := []string{}
+	if c.cm == nil {
+		return racks
+	}
+	for _, b := range c.cm.Buckets {
+		if b.Type == "rack" {
+			racks = append(racks, b.Name)
+		}
+	}
+	sort.Strings(racks)
+	return racks
+}
 
 type svcUpdates struct {
 	sync.RWMutex
@@ -96,6 +322,11 @@ func (su *svcUpdates) get(svcname, handler string) int64 {
 	defer su.RUnlock()
 	return su.m[svcname][handler]
 }
+func (su *svcUpdates) remove(svcname string) {
+	su.Lock()
+	delete(su.m, svcname)
+	su.Unlock()
+}
 func (su *svcUpdates) getMostRecent(svcname string) (string, int64) {
 	su.RLock()
 	defer su.RUnlock()
@@ -104,7 +335,7 @@ func (su *svcUpdates) getMostRecent(svcname string) (string, int64) {
 	for h, t := range su.m[svcname] {
 		if t > time {
 			handler = h
-			t = time
+			time = t
 		}
 	}
 	return handler, time
@@ -122,6 +353,40 @@ func main() {
 	sigchan := whiplash.AppSetup("whiplash-aggregator", "0.1.1", petrel.Pkgname, petrel.Version)
 	defer whiplash.AppCleanup("whiplash-aggregator")
 
+	// everything the handlers read is set up before the petrel
+	// instances start dispatching to them. first load the CRUSH map,
+	// and keep it fresh if we've been asked to
+	crushfile = wl.Aggregator.CrushFile
+	if _, err := crushReload(); err != nil {
+		log.Println("couldn't load CRUSH map:", err)
+	}
+	if wl.Aggregator.CrushInterval > 0 {
+		crushticker := time.NewTicker(time.Second * time.Duration(wl.Aggregator.CrushInterval))
+		go crushReloader(crushticker.C)
+	}
+
+	// start checking for services which have gone quiet
+	stalecheck, err = newLiveness(wl.Aggregator.Staleness)
+	if err != nil {
+		log.Fatal(err)
+	}
+	staleticker := time.NewTicker(time.Second * time.Duration(stalecheck.interval))
+	go staleSweeper(staleticker.C)
+
+	// set up stat forwarding
+	if g := wl.Aggregator.Sinks.Graphite; g != nil {
+		sinks = append(sinks, newGraphiteSink(g))
+		log.Println("forwarding stats to graphite at", g.Addr)
+	}
+	if i := wl.Aggregator.Sinks.Influx; i != nil {
+		is, err := newInfluxSink(i)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, is)
+		log.Println("forwarding stats to influxdb at", i.URL)
+	}
+
 	// setup the client petrel instance. first set the msglvl, then
 	// instantiate the petrel.
 	phconf := &petrel.Config{
@@ -137,6 +402,8 @@ func main() {
 	handlers := map[string]petrel.DispatchFunc{
 		"ping": pingHandler,
 		"stat": statHandler,
+		"added": addedHandler,
+		"removed": removedHandler,
 	}
 	for name, handler := range handlers {
 		err = cph.AddFunc(name, "nosplit", handler)
@@ -157,10 +424,7 @@ func main() {
 		log.Fatal(err)
 	}
 	// add command handlers to the query petrel instance
-	handlers = map[string]petrel.DispatchFunc{
-		"echo": qhEcho,
-	}
-	for name, handler := range handlers {
+	for name, handler := range queryHandlers {
 		err = qph.AddFunc(name, "split", handler)
 		if err != nil {
 			log.Fatal(err)
@@ -168,6 +432,11 @@ func main() {
 	}
 	log.Println("query petrel instantiated")
 
+	// start the HTTP listener, if configured
+	if wl.Aggregator.HTTPPort != "" {
+		go httpServe(wl.Aggregator.BindAddr + ":" + wl.Aggregator.HTTPPort)
+	}
+
 
 	// create a channel for the client petrel Msgr handler
 	msgchan := make(chan error, 1)
@@ -216,6 +485,15 @@ func main() {
 	}
 }
 
+// crushReloader reloads the CRUSH map on every tick of `tc`.
+func crushReloader(tc <-chan time.Time) {
+	for _ = range tc {
+		if _, err := crushReload(); err != nil {
+			log.Println("couldn't reload CRUSH map:", err)
+		}
+	}
+}
+
 func msgHandler(ph *petrel.Handler, msgchan chan error) {
 	for msg := range ph.Msgr {
 		// wait on a Msg to arrive and do a switch based on status code
@@ -0,0 +1,163 @@
+package main
+
+// This file contains the Prometheus exporter, which serves the
+// aggregator's view of the cluster in the Prometheus text exposition
+// format.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// promLabel is a Prometheus label name/value pair.
+type promLabel struct {
+	name, value string
+}
+
+// promSample is a single sample of a Prometheus metric.
+type promSample struct {
+	labels []promLabel
+	value float64
+}
+
+// promFamily is a Prometheus metric and all its samples.
+type promFamily struct {
+	name, typ, help string
+	samples []promSample
+}
+
+// metricsHandler serves /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, time.Now())
+}
+
+// writeMetrics writes the exposition of every metric we export to
+// `w`. Ages are computed relative to `now`.
+func writeMetrics(w io.Writer, now time.Time) {
+	svcs := svcstat.getAll()
+	sort.Slice(svcs, func(i, j int) bool { return svcLess(svcs[i].Name, svcs[j].Name) })
+
+	build := &promFamily{name: "whiplash_build_info", typ: "gauge",
+		help: "Whiplash library version of the aggregator"}
+	build.add([]promLabel{{"version", whiplash.Version}}, 1)
+	info := &promFamily{name: "whiplash_service_info", typ: "gauge",
+		help: "Ceph version of each service"}
+	rep := &promFamily{name: "whiplash_service_reporting", typ: "gauge",
+		help: "Whether a service is reporting (1) or not (0)"}
+	state := &promFamily{name: "whiplash_service_state", typ: "gauge",
+		help: "Liveness state of a service: 1 for its current state, 0 for the others"}
+	seen := &promFamily{name: "whiplash_service_last_seen_seconds", typ: "gauge",
+		help: "Seconds since the last update of each kind from a service"}
+	used := &promFamily{name: "whiplash_osd_bytes_used", typ: "gauge",
+		help: "Data stored on an OSD"}
+	avail := &promFamily{name: "whiplash_osd_bytes_avail", typ: "gauge",
+		help: "Space remaining on an OSD"}
+	total := &promFamily{name: "whiplash_osd_bytes_total", typ: "gauge",
+		help: "Size of an OSD's filesystem"}
+	fill := &promFamily{name: "whiplash_osd_fill_ratio", typ: "gauge",
+		help: "Fraction of an OSD's filesystem which is used"}
+	weight := &promFamily{name: "whiplash_osd_crush_weight", typ: "gauge",
+		help: "CRUSH weight of an OSD"}
+	reweight := &promFamily{name: "whiplash_osd_reweight", typ: "gauge",
+		help: "Override weight of an OSD"}
+	pgs := &promFamily{name: "whiplash_osd_pgs", typ: "gauge",
+		help: "PGs on an OSD, by role"}
+
+	for _, svc := range svcs {
+		labels := svcLabels(svc)
+		info.add(append(labels, promLabel{"version", svc.Version}), 1)
+		rep.add(labels, promBool(svc.Reporting))
+		for _, st := range []string{whiplash.SvcUp, whiplash.SvcLate, whiplash.SvcStale, whiplash.SvcGone} {
+			state.add(append(labels, promLabel{"state", st}), promBool(svc.State == st))
+		}
+		for _, handler := range []string{"ping", "stat"} {
+			if ts := lastseen.get(svc.Name, handler); ts != 0 {
+				seen.add(append(labels, promLabel{"update", handler}), now.Sub(time.Unix(ts, 0)).Seconds())
+			}
+		}
+		if svc.Type != whiplash.OSD {
+			continue
+		}
+		stat := osdStat(svc.Name)
+		if stat == nil {
+			continue
+		}
+		used.add(labels, float64(stat.BytesUsed))
+		avail.add(labels, float64(stat.BytesAvail))
+		total.add(labels, float64(stat.BytesTotal))
+		fill.add(labels, stat.FillRatio)
+		weight.add(labels, float64(stat.Weight))
+		reweight.add(labels, float64(stat.Reweight))
+		pgs.add(append(labels, promLabel{"role", "primary"}), float64(stat.PgPrimary))
+		pgs.add(append(labels, promLabel{"role", "replica"}), float64(stat.PgReplica))
+	}
+
+	for _, pf := range []*promFamily{build, info, rep, state, seen, used, avail, total, fill, weight, reweight, pgs} {
+		pf.write(w)
+	}
+}
+
+// svcLabels returns the identifying labels of a service, including
+// its location in the CRUSH hierarchy.
+func svcLabels(svc *whiplash.SvcCore) []promLabel {
+	host, rack, row := crushmap.locate(svc)
+	return []promLabel{
+		{"svc", svc.Name},
+		{"type", whiplash.SvcTypeName(svc.Type)},
+		{"host", host},
+		{"rack", rack},
+		{"row", row},
+	}
+}
+
+// add appends a sample to a promFamily. `labels` is copied, so
+// callers may append to a shared base slice.
+func (pf *promFamily) add(labels []promLabel, value float64) {
+	l := make([]promLabel, len(labels))
+	copy(l, labels)
+	pf.samples = append(pf.samples, promSample{labels: l, value: value})
+}
+
+// write writes the exposition of a promFamily to `w`. Families with
+// no samples are skipped.
+func (pf *promFamily) write(w io.Writer) {
+	if len(pf.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", pf.name, pf.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", pf.name, pf.typ)
+	for _, s := range pf.samples {
+		fmt.Fprint(w, pf.name)
+		if len(s.labels) > 0 {
+			chunks := make([]string, len(s.labels))
+			for i, l := range s.labels {
+				chunks[i] = l.name + "=\"" + promEscape(l.value) + "\""
+			}
+			fmt.Fprint(w, "{"+strings.Join(chunks, ",")+"}")
+		}
+		fmt.Fprintln(w, " "+strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// promEscape escapes a label value.
+func promEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// promBool turns a bool into a sample value.
+func promBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
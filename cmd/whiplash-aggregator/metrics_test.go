@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	svcstat.set("osd.1", &whiplash.SvcCore{Name: "osd.1", Type: whiplash.OSD, Host: "node1", Version: "0.94.5", Reporting: true})
+	svcstat.set("mon.a", &whiplash.SvcCore{Name: "mon.a", Type: whiplash.MON, Host: "node\"2", Version: "0.94.5"})
+	svcdata.setOsd("osd.1", &whiplash.OsdStat{BytesUsed: 100, BytesAvail: 300, BytesTotal: 400, FillRatio: 0.25, PgPrimary: 3, PgReplica: 5})
+	lastseen.set("osd.1", "stat", now.Add(-10*time.Second).Unix())
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, now)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE whiplash_osd_bytes_used gauge\n",
+		`whiplash_osd_bytes_used{svc="osd.1",type="osd",host="node1",rack="",row=""} 100` + "\n",
+		`whiplash_osd_fill_ratio{svc="osd.1",type="osd",host="node1",rack="",row=""} 0.25` + "\n",
+		`whiplash_osd_pgs{svc="osd.1",type="osd",host="node1",rack="",row="",role="replica"} 5` + "\n",
+		`whiplash_service_reporting{svc="mon.a",type="mon",host="node\"2",rack="",row=""} 0` + "\n",
+		`whiplash_service_last_seen_seconds{svc="osd.1",type="osd",host="node1",rack="",row="",update="stat"} 10` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q; got:\n%s", want, out)
+		}
+	}
+	// services sort by type, then number
+	if strings.Index(out, `svc="mon.a"`) > strings.Index(out, `svc="osd.1"`) {
+		t.Errorf("services out of order:\n%s", out)
+	}
+}
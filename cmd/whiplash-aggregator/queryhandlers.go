@@ -2,11 +2,44 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sboyettedh/whiplash"
 )
 
+// queryHandlers maps query commands to their handlers. This is the
+// dispatch table for both the query petrel instance and the HTTP API,
+// so a command added here is available over both.
+var queryHandlers = map[string]func([][]byte) ([]byte, error){
+	"echo": qhEcho,
+	"status": qhStatus,
+	"crushreload": qhCrushReload,
+	"lastseen": qhLastSeen,
+	"where": qhWhere,
+}
+
+// queryDispatch runs the handler for `cmd` on `args`. Unknown
+// commands get a 404 response.
+func queryDispatch(cmd string, args [][]byte) ([]byte, error) {
+	handler, ok := queryHandlers[cmd]
+	if !ok {
+		resp := &whiplash.QueryResponse{Cmd: cmd}
+		for _, arg := range args {
+			resp.Args = append(resp.Args, string(arg))
+		}
+		if len(resp.Args) > 0 {
+			resp.Subcmd, resp.Args = resp.Args[0], resp.Args[1:]
+		}
+		return qhErr(resp, 404, fmt.Sprintf("unknown command '%s'", cmd))
+	}
+	return handler(args)
+}
+
 // qhStubResponse creates and returns a stub QueryResponse for a
 // successful request.
 func qhStubResponse(cmd string, args [][]byte) *whiplash.QueryResponse {
@@ -34,6 +67,15 @@ func qhErrNoSubCmd(cmd string) ([]byte, error){
 	return json.Marshal(resp)
 }
 
+// qhErr turns a stub response into an error response, with `msg` as
+// its data, and returns it.
+func qhErr(resp *whiplash.QueryResponse, code int, msg string) ([]byte, error) {
+	errstr, _ := json.Marshal(msg)
+	resp.Code = code
+	resp.Data = errstr
+	return json.Marshal(resp)
+}
+
 // qhEcho is an example query handler. It simply creates an
 // appropriate response and returns it.
 func qhEcho(args [][]byte) ([]byte, error) {
@@ -63,3 +105,339 @@ func qhEcho(args [][]byte) ([]byte, error) {
 	// signature, so just return that!
 	return json.Marshal(resp)
 }
+
+// qhStatus handles the 'status' command and its subcommands.
+func qhStatus(args [][]byte) ([]byte, error) {
+	if len(args) == 0 {
+		return qhErrNoSubCmd("status")
+	}
+	resp := qhStubResponse("status", args)
+	// everything but 'cluster' and 'tree' needs an argument
+	if resp.Subcmd != "cluster" && resp.Subcmd != "tree" && len(resp.Args) == 0 {
+		return qhErr(resp, 400, fmt.Sprintf("no %s given", resp.Subcmd))
+	}
+	var data interface{}
+	var err error
+	switch resp.Subcmd {
+	case "cluster":
+		data = statusCluster()
+	case "tree":
+		data = statusTree()
+	case "rack":
+		data, err = statusRack(resp.Args[0])
+	case "node":
+		data, err = statusNode(resp.Args[0])
+	case "osd":
+		data, err = statusOsd(resp.Args[0])
+	default:
+		return qhErr(resp, 400, fmt.Sprintf("unknown subcommand '%s'", resp.Subcmd))
+	}
+	if err != nil {
+		return qhErr(resp, 404, err.Error())
+	}
+	resp.Data, err = json.Marshal(data)
+	if err != nil {
+		log.Println("qhStatus: ", err)
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// statusCluster builds the report for 'status cluster'.
+func statusCluster() *whiplash.ClusterReport {
+	cr := &whiplash.ClusterReport{}
+	cr.Name = "cluster"
+	for _, svc := range svcstat.getAll() {
+		switch svc.Type {
+		case whiplash.OSD:
+			cr.AddOsd(svc, osdStat(svc.Name))
+		case whiplash.MON:
+			cr.Mons++
+			if svc.Reporting {
+				cr.MonsReporting++
+			}
+		case whiplash.RGW:
+			cr.Rgws++
+			if svc.Reporting {
+				cr.RgwsReporting++
+			}
+		}
+	}
+	cr.Racks, cr.Hosts = statusRollups(crushmap.getRacks(), svchosts.getHosts())
+	return cr
+}
+
+// statusRollups builds the per-rack and per-host rollups for 'status
+// cluster'. A CRUSH reload or a removed service can make a rack or
+// host disappear after it was listed, so any which no longer exist
+// are skipped.
+func statusRollups(racks, hosts []string) (rrs, nrs []*whiplash.CapacityReport) {
+	for _, rack := range racks {
+		rr, err := statusRack(rack)
+		if err != nil {
+			continue
+		}
+		rrs = append(rrs, &rr.CapacityReport)
+	}
+	for _, host := range hosts {
+		nr, err := statusNode(host)
+		if err != nil {
+			continue
+		}
+		if nr.Osds > 0 {
+			nrs = append(nrs, &nr.CapacityReport)
+		}
+	}
+	return rrs, nrs
+}
+
+// statusTree builds the report for 'status tree', which is what the
+// web dashboard draws its heatmap and services table from.
+func statusTree() *whiplash.TreeReport {
+	tr := &whiplash.TreeReport{Time: time.Now().Unix()}
+	if cm := crushmap.get(); cm != nil {
+		for _, root := range cm.Roots {
+			tr.Roots = append(tr.Roots, treeBucket(root))
+		}
+	}
+	svcs := svcstat.getAll()
+	sort.Slice(svcs, func(i, j int) bool { return svcLess(svcs[i].Name, svcs[j].Name) })
+	for _, svc := range svcs {
+		tr.Svcs = append(tr.Svcs, &whiplash.SvcReport{
+			Svc: svc,
+			LastPing: lastseen.get(svc.Name, "ping"),
+			LastStat: lastseen.get(svc.Name, "stat"),
+		})
+	}
+	return tr
+}
+
+// treeBucket converts a CRUSH bucket, and everything under it, for a
+// TreeReport.
+func treeBucket(b *whiplash.CrushBucket) *whiplash.TreeBucket {
+	tb := &whiplash.TreeBucket{Name: b.Name, Type: b.Type}
+	for _, child := range b.Buckets {
+		tb.Buckets = append(tb.Buckets, treeBucket(child))
+	}
+	for _, co := range b.Osds {
+		or, err := statusOsd(co.Name)
+		if err != nil {
+			// in the map, but never heard from
+			or = &whiplash.OsdReport{Svc: &whiplash.SvcCore{Name: co.Name, Type: whiplash.OSD, Host: b.Name}}
+		}
+		tb.Osds = append(tb.Osds, or)
+	}
+	return tb
+}
+
+// statusRack builds the report for 'status rack'.
+func statusRack(rack string) (*whiplash.RackReport, error) {
+	hosts, ok := crushmap.getHosts(rack)
+	if !ok {
+		return nil, fmt.Errorf("unknown rack '%s'", rack)
+	}
+	rr := &whiplash.RackReport{}
+	rr.Name = rack
+	for _, host := range hosts {
+		nr, err := statusNode(host)
+		if err != nil {
+			// host is in the CRUSH map but nothing on it has
+			// reported
+			nr = &whiplash.NodeReport{}
+			nr.Name = host
+		}
+		rr.Merge(&nr.CapacityReport)
+		rr.Hosts = append(rr.Hosts, &nr.CapacityReport)
+	}
+	return rr, nil
+}
+
+// statusNode builds the report for 'status node'.
+func statusNode(host string) (*whiplash.NodeReport, error) {
+	if !svchosts.hostexists(host) {
+		return nil, fmt.Errorf("unknown node '%s'", host)
+	}
+	nr := &whiplash.NodeReport{}
+	nr.Name = host
+	for _, svcname := range svchosts.getSvcs(host) {
+		svc := svcstat.get(svcname)
+		if svc == nil {
+			continue
+		}
+		if svc.Type == whiplash.OSD {
+			or, err := statusOsd(svcname)
+			if err != nil {
+				// a client reported an OSD under a name which
+				// isn't an OSD's
+				continue
+			}
+			nr.AddOsd(or.Svc, or.Stat)
+			nr.OsdDetail = append(nr.OsdDetail, or)
+		}
+		nr.Svcs = append(nr.Svcs, svc)
+	}
+	sort.Slice(nr.Svcs, func(i, j int) bool { return svcLess(nr.Svcs[i].Name, nr.Svcs[j].Name) })
+	sort.Slice(nr.OsdDetail, func(i, j int) bool {
+		return svcLess(nr.OsdDetail[i].Svc.Name, nr.OsdDetail[j].Svc.Name)
+	})
+	return nr, nil
+}
+
+// statusOsd builds the report for 'status osd'. `osd` may be given
+// as "12" or "osd.12".
+func statusOsd(osd string) (*whiplash.OsdReport, error) {
+	if !strings.HasPrefix(osd, "osd.") {
+		osd = "osd." + osd
+	}
+	svc := svcstat.get(osd)
+	if svc == nil || svc.Type != whiplash.OSD {
+		return nil, fmt.Errorf("unknown osd '%s'", osd)
+	}
+	or := &whiplash.OsdReport{
+		Svc: svc,
+		Stat: osdStat(osd),
+		LastPing: lastseen.get(osd, "ping"),
+		LastStat: lastseen.get(osd, "stat"),
+	}
+	return or, nil
+}
+
+// svcLess sorts service names by type, then numerically by ID where
+// possible, so that osd.9 comes before osd.10.
+func svcLess(a, b string) bool {
+	ai := strings.LastIndex(a, ".")
+	bi := strings.LastIndex(b, ".")
+	if ai < 0 || bi < 0 || a[:ai] != b[:bi] {
+		return a < b
+	}
+	an, aerr := strconv.Atoi(a[ai+1:])
+	bn, berr := strconv.Atoi(b[bi+1:])
+	if aerr != nil || berr != nil {
+		return a < b
+	}
+	return an < bn
+}
+
+// qhCrushReload handles the 'crushreload' command.
+func qhCrushReload(args [][]byte) ([]byte, error) {
+	resp := &whiplash.QueryResponse{Code: 200, Cmd: "crushreload"}
+	for _, arg := range args {
+		resp.Args = append(resp.Args, string(arg))
+	}
+	report, err := crushReload()
+	if err != nil {
+		return qhErr(resp, 500, err.Error())
+	}
+	resp.Data, err = json.Marshal(report)
+	if err != nil {
+		log.Println("qhCrushReload: ", err)
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// qhLastSeen handles the 'lastseen' command. With no arguments, it
+// reports on every service. Otherwise each argument is a service or
+// host name, and it reports on those services, or the services on
+// those hosts.
+func qhLastSeen(args [][]byte) ([]byte, error) {
+	resp := &whiplash.QueryResponse{Code: 200, Cmd: "lastseen"}
+	for _, arg := range args {
+		resp.Args = append(resp.Args, string(arg))
+	}
+	var svcs []*whiplash.SvcCore
+	if len(resp.Args) == 0 {
+		svcs = svcstat.getAll()
+	}
+	seen := map[string]bool{}
+	for _, name := range resp.Args {
+		names := []string{name}
+		if svcstat.get(name) == nil {
+			if !svchosts.hostexists(name) {
+				return qhErr(resp, 404, fmt.Sprintf("unknown service or node '%s'", name))
+			}
+			names = svchosts.getSvcs(name)
+		}
+		for _, n := range names {
+			if svc := svcstat.get(n); svc != nil && !seen[n] {
+				seen[n] = true
+				svcs = append(svcs, svc)
+			}
+		}
+	}
+	ls := &whiplash.LastSeenReport{Time: time.Now().Unix()}
+	recent := map[string]int64{}
+	for _, svc := range svcs {
+		_, recent[svc.Name] = lastseen.getMostRecent(svc.Name)
+		ls.Svcs = append(ls.Svcs, &whiplash.SvcReport{
+			Svc: svc,
+			LastPing: lastseen.get(svc.Name, "ping"),
+			LastStat: lastseen.get(svc.Name, "stat"),
+		})
+	}
+	sort.Slice(ls.Svcs, func(i, j int) bool {
+		a, b := ls.Svcs[i].Svc.Name, ls.Svcs[j].Svc.Name
+		if recent[a] != recent[b] {
+			return recent[a] < recent[b]
+		}
+		return svcLess(a, b)
+	})
+	var err error
+	resp.Data, err = json.Marshal(ls)
+	if err != nil {
+		log.Println("qhLastSeen: ", err)
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// qhWhere handles the 'where' command, which reports the host and
+// CRUSH location of each service named in its arguments. OSDs may be
+// given as "12" or "osd.12".
+func qhWhere(args [][]byte) ([]byte, error) {
+	resp := &whiplash.QueryResponse{Code: 200, Cmd: "where"}
+	for _, arg := range args {
+		resp.Args = append(resp.Args, string(arg))
+	}
+	if len(resp.Args) == 0 {
+		return qhErr(resp, 400, "no service given")
+	}
+	var wrs []*whiplash.WhereReport
+	for _, name := range resp.Args {
+		if _, err := strconv.Atoi(name); err == nil {
+			name = "osd." + name
+		}
+		host, ok := svchosts.getHost(name)
+		svc := svcstat.get(name)
+		if !ok || svc == nil {
+			return qhErr(resp, 404, fmt.Sprintf("unknown service '%s'", name))
+		}
+		wrs = append(wrs, &whiplash.WhereReport{
+			Svc: name,
+			Host: host,
+			Location: crushmap.location(svc),
+		})
+	}
+	var err error
+	resp.Data, err = json.Marshal(wrs)
+	if err != nil {
+		log.Println("qhWhere: ", err)
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// crushReload loads a fresh CRUSH map, swaps it in for the current
+// one, and reports on what changed.
+func crushReload() (*whiplash.CrushReloadReport, error) {
+	cm, err := whiplash.CrushLoad(crushfile)
+	if err != nil {
+		return nil, err
+	}
+	old := crushmap.swap(cm)
+	report := &whiplash.CrushReloadReport{Buckets: len(cm.Buckets), Osds: len(cm.Osds)}
+	report.BucketsChanged, report.OsdsChanged = cm.Changes(old)
+	log.Printf("CRUSH map loaded: %d buckets (%d changed), %d osds (%d changed)\n",
+		report.Buckets, report.BucketsChanged, report.Osds, report.OsdsChanged)
+	return report, nil
+}
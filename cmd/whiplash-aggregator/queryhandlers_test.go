@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestGetMostRecent(t *testing.T) {
+	su := &svcUpdates{m: make(map[string]map[string]int64)}
+	if h, ts := su.getMostRecent("osd.1"); h != "" || ts != 0 {
+		t.Errorf("unknown service should have no updates; got %s %d", h, ts)
+	}
+	su.set("osd.1", "ping", 200)
+	su.set("osd.1", "stat", 100)
+	if h, ts := su.getMostRecent("osd.1"); h != "ping" || ts != 200 {
+		t.Errorf("expected ping 200, got %s %d", h, ts)
+	}
+	su.set("osd.1", "stat", 300)
+	if h, ts := su.getMostRecent("osd.1"); h != "stat" || ts != 300 {
+		t.Errorf("expected stat 300, got %s %d", h, ts)
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	for _, u := range []struct {
+		name, host string
+		ping, stat int64
+	}{
+		{"osd.50", "lsnode1", 500, 400},
+		{"osd.51", "lsnode1", 100, 0},
+		{"mon.ls", "lsnode2", 300, 350},
+	} {
+		svcstat.set(u.name, &whiplash.SvcCore{Name: u.name, Host: u.host})
+		svchosts.set(u.host, u.name)
+		lastseen.set(u.name, "ping", u.ping)
+		if u.stat != 0 {
+			lastseen.set(u.name, "stat", u.stat)
+		}
+	}
+	lsquery := func(args ...string) (*whiplash.QueryResponse, *whiplash.LastSeenReport) {
+		var bargs [][]byte
+		for _, a := range args {
+			bargs = append(bargs, []byte(a))
+		}
+		b, err := qhLastSeen(bargs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &whiplash.QueryResponse{}
+		ls := &whiplash.LastSeenReport{}
+		json.Unmarshal(b, resp)
+		if resp.Code == 200 {
+			json.Unmarshal(resp.Data, ls)
+		}
+		return resp, ls
+	}
+	names := func(ls *whiplash.LastSeenReport) []string {
+		var n []string
+		for _, sr := range ls.Svcs {
+			n = append(n, sr.Svc.Name)
+		}
+		return n
+	}
+
+	// by host and by service, oldest first
+	_, ls := lsquery("lsnode1", "mon.ls")
+	if got := names(ls); len(got) != 3 || got[0] != "osd.51" || got[1] != "mon.ls" || got[2] != "osd.50" {
+		t.Errorf("expected osd.51, mon.ls, osd.50; got %v", got)
+	}
+	if sr := ls.Svcs[2]; sr.LastPing != 500 || sr.LastStat != 400 {
+		t.Errorf("bad timestamps for osd.50: %+v", sr)
+	}
+	// duplicates are only listed once
+	if _, ls := lsquery("osd.50", "lsnode1"); len(ls.Svcs) != 2 {
+		t.Errorf("expected 2 services, got %v", names(ls))
+	}
+	// everything
+	if _, ls := lsquery(); len(ls.Svcs) < 3 {
+		t.Errorf("expected all services, got %v", names(ls))
+	}
+	if resp, _ := lsquery("nosuch"); resp.Code != 404 {
+		t.Errorf("unknown name should 404, got %d", resp.Code)
+	}
+}
+
+func TestSvcHostIndex(t *testing.T) {
+	si := &svcHostIndex{h2s: make(map[string]map[string]bool), s2h: make(map[string]string)}
+	si.set("node1", "osd.10")
+	si.set("node1", "osd.2")
+	// repeated updates don't duplicate
+	si.set("node1", "osd.2")
+	if svcs := si.getSvcs("node1"); len(svcs) != 2 || svcs[0] != "osd.2" || svcs[1] != "osd.10" {
+		t.Errorf("expected [osd.2 osd.10], got %v", svcs)
+	}
+	// a move takes the service off the old host
+	si.set("node2", "osd.10")
+	if svcs := si.getSvcs("node1"); len(svcs) != 1 || svcs[0] != "osd.2" {
+		t.Errorf("osd.10 should have left node1: %v", svcs)
+	}
+	if host, ok := si.getHost("osd.10"); !ok || host != "node2" {
+		t.Errorf("osd.10 should be on node2, got %s", host)
+	}
+	// and removing the last service on a host forgets the host
+	si.remove("osd.2")
+	if si.hostexists("node1") {
+		t.Errorf("node1 should be gone")
+	}
+	if _, ok := si.getHost("osd.2"); ok {
+		t.Errorf("osd.2 should be gone")
+	}
+	if hosts := si.getHosts(); len(hosts) != 1 || hosts[0] != "node2" {
+		t.Errorf("expected [node2], got %v", hosts)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	crushfile = "../../test_corpus/osdtree.json"
+	defer func() { crushfile = ""; crushmap.swap(nil) }()
+	if _, err := crushReload(); err != nil {
+		t.Fatal(err)
+	}
+	setSvc(&whiplash.SvcCore{Name: "osd.9903", Type: whiplash.OSD, Host: "cephstore9998"})
+	setSvc(&whiplash.SvcCore{Name: "mon.where", Type: whiplash.MON, Host: "cephstore9999"})
+	b, _ := qhWhere([][]byte{[]byte("9903"), []byte("mon.where")})
+	resp := &whiplash.QueryResponse{}
+	json.Unmarshal(b, resp)
+	var wrs []*whiplash.WhereReport
+	if err := json.Unmarshal(resp.Data, &wrs); err != nil || len(wrs) != 2 {
+		t.Fatalf("bad response %s", b)
+	}
+	if wrs[0].Svc != "osd.9903" || wrs[0].Host != "cephstore9998" || wrs[0].Location["chassis"] != "chassis-a" || wrs[0].Location["row"] != "irv-n" {
+		t.Errorf("bad location for osd.9903: %+v", wrs[0])
+	}
+	if wrs[1].Location["host"] != "cephstore9999" || wrs[1].Location["rack"] != "irv-n1" {
+		t.Errorf("bad location for mon.where: %+v", wrs[1])
+	}
+	// a service which moves is found in its new home
+	setSvc(&whiplash.SvcCore{Name: "mon.where", Type: whiplash.MON, Host: "cephstore9998"})
+	b, _ = qhWhere([][]byte{[]byte("mon.where")})
+	json.Unmarshal(b, resp)
+	json.Unmarshal(resp.Data, &wrs)
+	if wrs[0].Host != "cephstore9998" || wrs[0].Location["rack"] != "irv-n2" {
+		t.Errorf("mon.where should have moved: %+v", wrs[0])
+	}
+	if b, _ = qhWhere([][]byte{[]byte("osd.424242")}); !json.Valid(b) {
+		t.Fatalf("bad response %s", b)
+	}
+	json.Unmarshal(b, resp)
+	if resp.Code != 404 {
+		t.Errorf("unknown service should 404, got %d", resp.Code)
+	}
+}
+
+// freshStores swaps in empty service stores, for tests which need to
+// know exactly what is in them, and returns a func which puts the old
+// ones back.
+func freshStores() func() {
+	ostat, odata, ohosts, oseen := svcstat, svcdata, svchosts, lastseen
+	svcstat = &svcStatus{m: make(map[string]*whiplash.SvcCore)}
+	svcdata = &svcStatData{
+		osd: make(map[string]*whiplash.OsdStat),
+		mon: make(map[string]*whiplash.MonStat),
+		rgw: make(map[string]*whiplash.RgwStat),
+	}
+	svchosts = &svcHostIndex{h2s: make(map[string]map[string]bool), s2h: make(map[string]string)}
+	lastseen = &svcUpdates{m: make(map[string]map[string]int64)}
+	return func() {
+		svcstat, svcdata, svchosts, lastseen = ostat, odata, ohosts, oseen
+	}
+}
+
+// queryArgs turns strings into query handler arguments.
+func queryArgs(args ...string) [][]byte {
+	bargs := [][]byte{}
+	for _, arg := range args {
+		bargs = append(bargs, []byte(arg))
+	}
+	return bargs
+}
+
+func TestStatus(t *testing.T) {
+	defer freshStores()()
+	crushfile = "../../test_corpus/osdtree.json"
+	defer func() { crushfile = ""; crushmap.swap(nil) }()
+	if _, err := crushReload(); err != nil {
+		t.Fatal(err)
+	}
+	setSvc(&whiplash.SvcCore{Name: "osd.9900", Type: whiplash.OSD, Host: "cephstore9999", Reporting: true})
+	svcdata.setOsd("osd.9900", &whiplash.OsdStat{BytesUsed: 100, BytesAvail: 850, BytesTotal: 1000, PgPrimary: 10, PgReplica: 20})
+	setSvc(&whiplash.SvcCore{Name: "osd.9901", Type: whiplash.OSD, Host: "cephstore9999", Reporting: true})
+	setSvc(&whiplash.SvcCore{Name: "osd.9903", Type: whiplash.OSD, Host: "cephstore9998"})
+	setSvc(&whiplash.SvcCore{Name: "mon.a", Type: whiplash.MON, Host: "cephstore9999", Reporting: true})
+	setSvc(&whiplash.SvcCore{Name: "client.radosgw.gw1", Type: whiplash.RGW, Host: "gw1"})
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"cluster"}, 200},
+		{[]string{"tree"}, 200},
+		{[]string{"rack", "irv-n1"}, 200},
+		{[]string{"rack", "irv-n2"}, 200},
+		{[]string{"node", "cephstore9999"}, 200},
+		{[]string{"osd", "9900"}, 200},
+		{[]string{"osd", "osd.9900"}, 200},
+		{[]string{}, 400},
+		{[]string{"rack"}, 400},
+		{[]string{"node"}, 400},
+		{[]string{"osd"}, 400},
+		{[]string{"nosuch"}, 400},
+		{[]string{"rack", "nosuch"}, 404},
+		// a row is a bucket, but not a rack
+		{[]string{"rack", "irv-n"}, 404},
+		{[]string{"node", "nosuch"}, 404},
+		{[]string{"osd", "9999"}, 404},
+		{[]string{"osd", "mon.a"}, 404},
+	}
+	data := map[string]json.RawMessage{}
+	for _, test := range tests {
+		b, err := qhStatus(queryArgs(test.args...))
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+			continue
+		}
+		resp := &whiplash.QueryResponse{}
+		if err := json.Unmarshal(b, resp); err != nil {
+			t.Errorf("%v: bad response: %s", test.args, b)
+			continue
+		}
+		if resp.Code != test.code {
+			t.Errorf("%v: expected code %d but got %d: %s", test.args, test.code, resp.Code, resp.Data)
+		}
+		if resp.Code == 200 {
+			data[strings.Join(test.args, " ")] = resp.Data
+		}
+	}
+
+	cr := &whiplash.ClusterReport{}
+	json.Unmarshal(data["cluster"], cr)
+	if cr.Osds != 3 || cr.OsdsReporting != 2 || cr.BytesUsed != 100 || cr.BytesTotal != 1000 || cr.Mons != 1 || cr.MonsReporting != 1 || cr.Rgws != 1 || cr.RgwsReporting != 0 {
+		t.Errorf("bad cluster report: %+v", cr)
+	}
+	if len(cr.Racks) != 2 || cr.Racks[0].Name != "irv-n1" || cr.Racks[0].Osds != 2 || cr.Racks[1].Osds != 1 {
+		t.Errorf("bad cluster rack rollups: %v", cr.Racks)
+	}
+	// gw1 has no OSDs, so it doesn't get a rollup
+	if len(cr.Hosts) != 2 || cr.Hosts[0].Name != "cephstore9998" || cr.Hosts[1].Name != "cephstore9999" {
+		t.Errorf("bad cluster host rollups: %v", cr.Hosts)
+	}
+	rr := &whiplash.RackReport{}
+	json.Unmarshal(data["rack irv-n2"], rr)
+	if rr.Name != "irv-n2" || rr.Osds != 1 || rr.OsdsReporting != 0 || len(rr.Hosts) != 1 || rr.Hosts[0].Name != "cephstore9998" {
+		t.Errorf("bad rack report: %+v", rr)
+	}
+	nr := &whiplash.NodeReport{}
+	json.Unmarshal(data["node cephstore9999"], nr)
+	if nr.Osds != 2 || nr.PgPrimary != 10 || nr.BytesTotal != 1000 || len(nr.Svcs) != 3 || nr.Svcs[0].Name != "mon.a" || len(nr.OsdDetail) != 2 || nr.OsdDetail[1].Svc.Name != "osd.9901" {
+		t.Errorf("bad node report: %+v", nr)
+	}
+	or := &whiplash.OsdReport{}
+	json.Unmarshal(data["osd 9900"], or)
+	if or.Svc.Name != "osd.9900" || or.Stat == nil || or.Stat.BytesAvail != 850 {
+		t.Errorf("bad osd report: %+v", or)
+	}
+	if string(data["osd 9900"]) != string(data["osd osd.9900"]) {
+		t.Errorf("'osd 9900' and 'osd osd.9900' should match")
+	}
+	tr := &whiplash.TreeReport{}
+	json.Unmarshal(data["tree"], tr)
+	if len(tr.Roots) != 1 || len(tr.Svcs) != 5 {
+		t.Errorf("bad tree report: %d roots, %d svcs", len(tr.Roots), len(tr.Svcs))
+	}
+
+	// racks and hosts which vanish between being listed and being
+	// looked up are skipped
+	rrs, nrs := statusRollups([]string{"irv-n1", "gone"}, []string{"gone", "cephstore9999"})
+	if len(rrs) != 1 || rrs[0].Name != "irv-n1" || len(nrs) != 1 || nrs[0].Name != "cephstore9999" {
+		t.Errorf("bad rollups with missing racks and hosts: %v %v", rrs, nrs)
+	}
+	// an OSD-typed service without an OSD's name is left out of its
+	// node's report, rather than crashing it
+	setSvc(&whiplash.SvcCore{Name: "weird", Type: whiplash.OSD, Host: "cephstore9999"})
+	nr, err := statusNode("cephstore9999")
+	if err != nil || len(nr.Svcs) != 3 || nr.Osds != 2 {
+		t.Errorf("bad node report with a misnamed OSD: %+v, %v", nr, err)
+	}
+	b, _ := qhStatus(queryArgs("cluster"))
+	resp := &whiplash.QueryResponse{}
+	if err := json.Unmarshal(b, resp); err != nil || resp.Code != 200 {
+		t.Errorf("cluster status failed with a misnamed OSD: %s", b)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+// This file contains the plumbing for sinks, which are outputs that
+// the aggregator forwards stat updates to as they arrive.
+//
+// All our sinks speak line-oriented protocols, so they share
+// lineSink, which buffers lines in memory and writes them in batches
+// from a single goroutine, so that stat handlers never wait on the
+// network. If the endpoint goes away, the writer retries with
+// exponential backoff, and the buffer keeps the newest lines up to
+// its configured size.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// sink is an output for stat updates.
+type sink interface {
+	// send hands a stat update to the sink. `fields` is the stat, as
+	// flattened by statFields. send must not block on the network.
+	send(svc *whiplash.SvcCore, t int64, fields map[string]float64)
+}
+
+// sinks holds all configured sinks. It is set up in main() before the
+// listeners start, and not modified after that.
+var sinks []sink
+
+// sendSinks hands a stat update to every configured sink.
+func sendSinks(svc *whiplash.SvcCore, t int64, stat interface{}) {
+	if len(sinks) == 0 {
+		return
+	}
+	fields := statFields(stat)
+	for _, s := range sinks {
+		s.send(svc, t, fields)
+	}
+}
+
+const (
+	sinkBatch = 500
+	sinkBuffer = 100000
+	// sinkFlush is the default flush interval, in milliseconds
+	sinkFlush = 1000
+	// sinkBackoff is the default maximum retry backoff, in seconds
+	sinkBackoff = 60
+	// sinkTimeout bounds connecting and writing to an endpoint
+	sinkTimeout = 5 * time.Second
+)
+
+// lineWriter delivers batches of lines to a sink's endpoint. It is
+// only called from the lineSink writer goroutine.
+type lineWriter interface {
+	// write sends a batch of lines. If it returns an error, the lines
+	// are requeued and retried after a backoff. If some of them were
+	// delivered before the error, it should return a *partialWrite,
+	// so that only the rest are retried.
+	write(lines []string) error
+	// close releases any connection held by the writer.
+	close()
+}
+
+// partialWrite is the error from a lineWriter which delivered the
+// first `sent` lines of a batch before failing.
+type partialWrite struct {
+	sent int
+	err error
+}
+
+func (pw *partialWrite) Error() string {
+	return fmt.Sprintf("%v (after %d lines)", pw.err, pw.sent)
+}
+
+// partialErr returns `err` as a *partialWrite if `sent` lines went
+// out before it, and unchanged if none did.
+func partialErr(sent int, err error) error {
+	if sent == 0 {
+		return err
+	}
+	return &partialWrite{sent: sent, err: err}
+}
+
+// lineSink is a bounded, batching line buffer in front of a
+// lineWriter.
+type lineSink struct {
+	sync.Mutex
+	name string
+	w lineWriter
+	batch int
+	max int
+	interval time.Duration
+	// minBackoff is the first retry delay; it doubles on each
+	// failure, up to maxBackoff
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// buf holds lines waiting to be written
+	buf []string
+	// dropped counts lines discarded because buf was full
+	dropped int
+	kick chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newLineSink returns a lineSink which writes with `w`, configured by
+// `conf`, and starts its writer. `name` is used in log messages.
+func newLineSink(name string, w lineWriter, conf whiplash.WLSinkBufConfig) *lineSink {
+	ls := &lineSink{
+		name: name,
+		w: w,
+		batch: conf.BatchSize,
+		max: conf.BufferSize,
+		interval: time.Duration(conf.FlushInterval) * time.Millisecond,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: time.Duration(conf.MaxBackoff) * time.Second,
+		kick: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if ls.batch <= 0 {
+		ls.batch = sinkBatch
+	}
+	if ls.max <= 0 {
+		ls.max = sinkBuffer
+	}
+	if ls.interval <= 0 {
+		ls.interval = sinkFlush * time.Millisecond
+	}
+	if ls.maxBackoff <= 0 {
+		ls.maxBackoff = sinkBackoff * time.Second
+	}
+	go ls.run()
+	return ls
+}
+
+// enqueue adds lines to the buffer, dropping the oldest lines if it
+// overflows, and wakes the writer if a full batch is ready.
+func (ls *lineSink) enqueue(lines []string) {
+	ls.Lock()
+	ls.buf = append(ls.buf, lines...)
+	ls.trim()
+	ready := len(ls.buf) >= ls.batch
+	ls.Unlock()
+	if ready {
+		select {
+		case ls.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// requeue puts lines which couldn't be written back at the front of
+// the buffer.
+func (ls *lineSink) requeue(lines []string) {
+	ls.Lock()
+	ls.buf = append(lines, ls.buf...)
+	ls.trim()
+	ls.Unlock()
+}
+
+// trim drops lines from the front of the buffer until it fits. The
+// caller must hold the lock.
+func (ls *lineSink) trim() {
+	if over := len(ls.buf) - ls.max; over > 0 {
+		if ls.dropped == 0 {
+			log.Println(ls.name, "buffer full; dropping oldest lines")
+		}
+		ls.dropped += over
+		ls.buf = append([]string(nil), ls.buf[over:]...)
+	}
+}
+
+// take removes and returns up to one batch of lines from the buffer.
+func (ls *lineSink) take() []string {
+	ls.Lock()
+	defer ls.Unlock()
+	n := len(ls.buf)
+	if n > ls.batch {
+		n = ls.batch
+	}
+	lines := ls.buf[:n:n]
+	ls.buf = ls.buf[n:]
+	return lines
+}
+
+// run is the writer loop. It drains the buffer on every flush tick
+// (or when a batch fills up), and backs off while the endpoint is
+// unreachable.
+func (ls *lineSink) run() {
+	defer close(ls.done)
+	defer ls.w.close()
+	ticker := time.NewTicker(ls.interval)
+	defer ticker.Stop()
+	backoff := time.Duration(0)
+	for {
+		select {
+		case <-ls.quit:
+			return
+		case <-ticker.C:
+		case <-ls.kick:
+		}
+		for {
+			lines := ls.take()
+			if len(lines) == 0 {
+				break
+			}
+			err := ls.w.write(lines)
+			if err == nil {
+				if backoff != 0 {
+					log.Println(ls.name, "writes restored")
+				}
+				backoff = 0
+				continue
+			}
+			// don't resend what already got through
+			if pw, ok := err.(*partialWrite); ok {
+				lines = lines[pw.sent:]
+			}
+			ls.requeue(lines)
+			if backoff == 0 {
+				log.Println(ls.name, "write failed:", err)
+				backoff = ls.minBackoff
+			} else {
+				backoff *= 2
+			}
+			if backoff > ls.maxBackoff {
+				backoff = ls.maxBackoff
+			}
+			select {
+			case <-ls.quit:
+				return
+			case <-time.After(backoff):
+			}
+		}
+	}
+}
+
+// close stops the writer. Buffered lines are discarded.
+func (ls *lineSink) close() {
+	close(ls.quit)
+	<-ls.done
+}
+
+// statFields flattens a stat struct into named values. Field names
+// are converted to snake_case ("BytesUsed" becomes
+// "bytes_used"). Numeric fields are kept; anything else
+// is dropped. Whitelisted perf counters are included as
+// "counters.<section>.<counter>".
+func statFields(stat interface{}) map[string]float64 {
+	b, err := json.Marshal(stat)
+	if err != nil {
+		return nil
+	}
+	var raw map[string]interface{}
+	if json.Unmarshal(b, &raw) != nil {
+		return nil
+	}
+	fields := map[string]float64{}
+	for k, v := range raw {
+		switch v := v.(type) {
+		case float64:
+			fields[snakeCase(k)] = v
+		case map[string]interface{}:
+			if k != "Counters" {
+				continue
+			}
+			for ck, cv := range v {
+				if f, ok := cv.(float64); ok {
+					fields["counters."+ck] = f
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// snakeCase converts a CamelCase name to snake_case. Runs of
+// capitals are treated as a single word, so "RWLatency" becomes
+// "rw_latency".
+func snakeCase(s string) string {
+	r := []rune(s)
+	out := make([]rune, 0, len(r)+4)
+	for i, c := range r {
+		if unicode.IsUpper(c) && i > 0 {
+			prevLower := unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1])
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if prevLower || (unicode.IsUpper(r[i-1]) && nextLower) {
+				out = append(out, '_')
+			}
+		}
+		out = append(out, unicode.ToLower(c))
+	}
+	return string(out)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestLineSinkBuffer(t *testing.T) {
+	// no writer running, so nothing leaves the buffer but take()
+	g := &lineSink{name: "test", batch: 3, max: 5, kick: make(chan struct{}, 1)}
+	for i := 0; i < 8; i++ {
+		g.enqueue([]string{fmt.Sprintf("l%d", i)})
+	}
+	if g.dropped != 3 || strings.Join(g.buf, ",") != "l3,l4,l5,l6,l7" {
+		t.Errorf("expected oldest 3 lines dropped; dropped %d, buf %v", g.dropped, g.buf)
+	}
+	batch := g.take()
+	if strings.Join(batch, ",") != "l3,l4,l5" {
+		t.Errorf("bad batch %v", batch)
+	}
+	// failed lines go back to the front, still within the bound
+	g.enqueue([]string{"l8", "l9"})
+	g.requeue(batch)
+	if strings.Join(g.buf, ",") != "l5,l6,l7,l8,l9" || g.dropped != 5 {
+		t.Errorf("requeue should keep the newest lines; dropped %d, buf %v", g.dropped, g.buf)
+	}
+}
+
+// partialWriter fails its first write after delivering `sent` lines,
+// and records everything it delivers.
+type partialWriter struct {
+	sync.Mutex
+	sent int
+	failed bool
+	lines []string
+}
+
+func (pw *partialWriter) write(lines []string) error {
+	pw.Lock()
+	defer pw.Unlock()
+	if !pw.failed {
+		pw.failed = true
+		pw.lines = append(pw.lines, lines[:pw.sent]...)
+		return partialErr(pw.sent, fmt.Errorf("network is down"))
+	}
+	pw.lines = append(pw.lines, lines...)
+	return nil
+}
+
+func (pw *partialWriter) close() {}
+
+func (pw *partialWriter) delivered() string {
+	pw.Lock()
+	defer pw.Unlock()
+	return strings.Join(pw.lines, ",")
+}
+
+func TestLineSinkPartialWrite(t *testing.T) {
+	pw := &partialWriter{sent: 2}
+	ls := newLineSink("test", pw, whiplash.WLSinkBufConfig{BatchSize: 4, FlushInterval: 10})
+	defer ls.close()
+	ls.enqueue([]string{"l0", "l1", "l2", "l3"})
+	// only the lines which didn't get through are retried, so
+	// everything arrives exactly once
+	deadline := time.Now().Add(3 * time.Second)
+	for pw.delivered() != "l0,l1,l2,l3" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected l0..l3 once each; got %s", pw.delivered())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatFields(t *testing.T) {
+	f := statFields(&whiplash.MonStat{Rank: 2, Leader: "a", Counters: map[string]float64{"mon.num_sessions": 4}})
+	if f["rank"] != 2 || f["counters.mon.num_sessions"] != 4 {
+		t.Errorf("bad fields %v", f)
+	}
+	if _, ok := f["leader"]; ok {
+		t.Errorf("string fields should be dropped: %v", f)
+	}
+	for in, want := range map[string]string{"BytesUsed": "bytes_used", "RWLatency": "rw_latency", "FillRatio": "fill_ratio", "Qlen": "qlen"} {
+		if got := snakeCase(in); got != want {
+			t.Errorf("snakeCase(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+// This file contains the liveness checks, which notice when services
+// stop sending updates. Clients only tell us about the services they
+// can see, so if a client dies, nothing else will ever mark its
+// services as down. The sweeper does that, by moving each service
+// through the up, late, stale, and gone states as its updates age.
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+// liveness holds the thresholds, in seconds, of the liveness checks.
+type liveness struct {
+	interval int64
+	pingLate int64
+	pingStale int64
+	statLate int64
+	statStale int64
+	gone int64
+}
+
+// stalecheck is the aggregator's liveness configuration. It holds the
+// defaults until main() loads the real configuration, which it does
+// before any handlers can run, so it is never modified after that.
+var stalecheck = &liveness{
+	interval: 15,
+	pingLate: 60,
+	pingStale: 300,
+	statLate: 900,
+	statStale: 1800,
+	gone: 86400,
+}
+
+// newLiveness returns a liveness configured by `conf`, with defaults
+// filling in unset values.
+func newLiveness(conf whiplash.WLStaleConfig) (*liveness, error) {
+	l := *stalecheck
+	for _, v := range []struct {
+		conf int64
+		val *int64
+	}{
+		{conf.Interval, &l.interval},
+		{conf.PingLate, &l.pingLate},
+		{conf.PingStale, &l.pingStale},
+		{conf.StatLate, &l.statLate},
+		{conf.StatStale, &l.statStale},
+		{conf.Gone, &l.gone},
+	} {
+		if v.conf > 0 {
+			*v.val = v.conf
+		}
+	}
+	if l.pingLate >= l.pingStale || l.statLate >= l.statStale {
+		return nil, fmt.Errorf("staleness: late thresholds must be less than stale thresholds")
+	}
+	if l.pingStale >= l.gone || l.statStale >= l.gone {
+		return nil, fmt.Errorf("staleness: stale thresholds must be less than gone")
+	}
+	return &l, nil
+}
+
+// state returns the liveness state of a service whose most recent
+// ping and stat updates were at `ping` and `stat`, as of `now`. A
+// timestamp of 0 means that kind of update has never been seen, and
+// it is ignored.
+func (l *liveness) state(now, ping, stat int64) string {
+	if ping == 0 && stat == 0 {
+		return whiplash.SvcGone
+	}
+	last := ping
+	if stat > last {
+		last = stat
+	}
+	if now-last > l.gone {
+		return whiplash.SvcGone
+	}
+	state := whiplash.SvcUp
+	if ping != 0 {
+		state = worseState(state, ageState(now-ping, l.pingLate, l.pingStale))
+	}
+	if stat != 0 {
+		state = worseState(state, ageState(now-stat, l.statLate, l.statStale))
+	}
+	return state
+}
+
+// ageState classifies an update age against a pair of thresholds.
+func ageState(age, late, stale int64) string {
+	switch {
+	case age > stale:
+		return whiplash.SvcStale
+	case age > late:
+		return whiplash.SvcLate
+	}
+	return whiplash.SvcUp
+}
+
+// stateRank orders liveness states from best to worst.
+var stateRank = map[string]int{
+	whiplash.SvcUp: 0,
+	whiplash.SvcLate: 1,
+	whiplash.SvcStale: 2,
+	whiplash.SvcGone: 3,
+}
+
+// worseState returns whichever of `a` and `b` is worse.
+func worseState(a, b string) string {
+	if stateRank[b] > stateRank[a] {
+		return b
+	}
+	return a
+}
+
+// updateState recomputes the liveness state of `svcname` as of `now`
+// and logs any transition. Services which are stale or gone are also
+// marked as not reporting, since whatever their client last told us
+// can no longer be trusted.
+func updateState(svcname string, now int64) {
+	svc := svcstat.get(svcname)
+	if svc == nil {
+		return
+	}
+	ping, stat := lastseen.get(svcname, "ping"), lastseen.get(svcname, "stat")
+	// a service which a client has announced, but which hasn't
+	// checked in yet, gets the same grace as a late ping
+	if ping == 0 && stat == 0 && now-lastseen.get(svcname, "added") <= stalecheck.pingLate {
+		return
+	}
+	state := stalecheck.state(now, ping, stat)
+	reporting := svc.Reporting && (state == whiplash.SvcUp || state == whiplash.SvcLate)
+	if state == svc.State && reporting == svc.Reporting {
+		return
+	}
+	if state != svc.State {
+		from := svc.State
+		if from == "" {
+			from = "new"
+		}
+		log.Println("state", svcname, from, "->", state)
+	}
+	// SvcCores are shared with anything that has read svcstat, so we
+	// replace rather than modify
+	updated := *svc
+	updated.State = state
+	updated.Reporting = reporting
+	svcstat.swap(svcname, svc, &updated)
+}
+
+// staleSweeper rechecks the state of every service on every tick of
+// `tc`.
+func staleSweeper(tc <-chan time.Time) {
+	for t := range tc {
+		for _, svc := range svcstat.getAll() {
+			updateState(svc.Name, t.Unix())
+		}
+	}
+}
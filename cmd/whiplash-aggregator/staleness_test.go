@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestLivenessState(t *testing.T) {
+	l, err := newLiveness(whiplash.WLStaleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int64(100000)
+	tests := []struct {
+		ping, stat int64
+		state string
+	}{
+		{now - 10, now - 100, whiplash.SvcUp},
+		// only pinged so far
+		{now - 10, 0, whiplash.SvcUp},
+		{now - 61, now - 100, whiplash.SvcLate},
+		{now - 10, now - 901, whiplash.SvcLate},
+		{now - 301, now - 100, whiplash.SvcStale},
+		// pings fine but stats stopped long ago
+		{now - 10, now - 1801, whiplash.SvcStale},
+		{now - 86401, now - 86401, whiplash.SvcGone},
+		{now - 86401, 0, whiplash.SvcGone},
+		{0, 0, whiplash.SvcGone},
+	}
+	for _, test := range tests {
+		if got := l.state(now, test.ping, test.stat); got != test.state {
+			t.Errorf("ping age %d, stat age %d: expected %s, got %s", now-test.ping, now-test.stat, test.state, got)
+		}
+	}
+}
+
+func TestNewLiveness(t *testing.T) {
+	l, err := newLiveness(whiplash.WLStaleConfig{PingLate: 30, Gone: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.pingLate != 30 || l.gone != 3600 || l.pingStale != 300 || l.interval != 15 {
+		t.Errorf("config not merged with defaults: %+v", l)
+	}
+	for _, conf := range []whiplash.WLStaleConfig{
+		{PingLate: 300, PingStale: 60},
+		{StatLate: 2000},
+		{Gone: 600},
+	} {
+		if _, err := newLiveness(conf); err == nil {
+			t.Errorf("thresholds %+v should have been refused", conf)
+		}
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	now := int64(100000)
+	name := "osd.77"
+	svcstat.set(name, &whiplash.SvcCore{Name: name, Type: whiplash.OSD, Reporting: true})
+	lastseen.set(name, "ping", now)
+	updateState(name, now)
+	first := svcstat.get(name)
+	if first.State != whiplash.SvcUp || !first.Reporting {
+		t.Fatalf("expected up and reporting, got %+v", first)
+	}
+	// nothing changes, so nothing is replaced
+	updateState(name, now+10)
+	if svcstat.get(name) != first {
+		t.Errorf("unchanged state shouldn't replace the SvcCore")
+	}
+	updateState(name, now+100)
+	if svc := svcstat.get(name); svc.State != whiplash.SvcLate || !svc.Reporting {
+		t.Errorf("expected late and still reporting, got %+v", svc)
+	}
+	updateState(name, now+1000)
+	svc := svcstat.get(name)
+	if svc.State != whiplash.SvcStale || svc.Reporting {
+		t.Errorf("expected stale and not reporting, got %+v", svc)
+	}
+	// earlier readers' copies are left alone
+	if first.State != whiplash.SvcUp || !first.Reporting {
+		t.Errorf("SvcCore was modified in place: %+v", first)
+	}
+	// and a fresh update brings it back, carrying the old state
+	// over so the transition is noticed
+	setSvc(&whiplash.SvcCore{Name: name, Type: whiplash.OSD, Reporting: true})
+	if svc := svcstat.get(name); svc.State != whiplash.SvcStale {
+		t.Errorf("state should carry over from the previous SvcCore, got %+v", svc)
+	}
+	lastseen.set(name, "ping", now+1000)
+	updateState(name, now+1000)
+	if svc := svcstat.get(name); svc.State != whiplash.SvcUp || !svc.Reporting {
+		t.Errorf("expected up again, got %+v", svc)
+	}
+}
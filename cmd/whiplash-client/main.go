@@ -6,6 +6,9 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 	"time"
 
 	"firepear.net/pclient"
@@ -14,7 +17,6 @@ import (
 
 var (
 	whipconf = flag.String("c", "/etc/whiplash.conf", "Whiplash configuration file")
-	hostname, _ = os.LookupEnv("HOSTNAME")
 	pcconf *pclient.Config
 	// nil payload for pings
 	nilPayload, _ = json.Marshal(nil)
@@ -27,6 +29,9 @@ var (
 		{"ping": 17, "stat": 307},
 		{"ping": 19, "stat": 293},
 	}
+	// how often, in seconds, to look for new and removed services,
+	// if the configuration doesn't say
+	rediscoverIntv int64 = 300
 )
 
 func main() {
@@ -37,6 +42,9 @@ func main() {
 	}
 	sigchan := whiplash.AppSetup("whiplash-client", "0.1.0", pclient.Pkgname, pclient.Version)
 	defer whiplash.AppCleanup("whiplash-client")
+	// SIGHUP makes us look for services again
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
 
 	// need a pclient configuration to talk to the aggregator with
 	pcconf = &pclient.Config{
@@ -48,11 +56,21 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 	intv = rand.Intn(len(intvs))
 	log.Printf("using interval set: %q\n", intvs[intv])
-	// create tickers and launch monitor funcs
-	pingticker := time.NewTicker(time.Second * intvs[intv]["ping"])
-	statticker := time.NewTicker(time.Second * intvs[intv]["stat"])
-	go pingSvcs(wl.Svcs, pingticker.C)
-	go statSvcs(wl.Svcs, statticker.C)
+	// launch pollers for the services we found at startup
+	pollers := make(map[string]*poller)
+	updatePollers(pollers, wl.Svcs)
+	// and set up periodic rediscovery. a nil channel never fires, so
+	// it disables the select case below.
+	var rdtick <-chan time.Time
+	rdi := wl.Client.Rediscover
+	if rdi == 0 {
+		rdi = rediscoverIntv
+	}
+	if rdi > 0 {
+		rdticker := time.NewTicker(time.Second * time.Duration(rdi))
+		defer rdticker.Stop()
+		rdtick = rdticker.C
+	}
 
 	// mainloop
 	keepalive := true
@@ -64,60 +82,170 @@ func main() {
 			// to handle the Msgs which will be incoming.
 			log.Println("OS signal received; shutting down")
 			keepalive = false
+		case <-hupchan:
+			log.Println("SIGHUP received; rediscovering services")
+			rediscover(wl, pollers)
+		case <-rdtick:
+			rediscover(wl, pollers)
 		}
 		// there's no default case in the select, as that would cause
 		// it to be nonblocking. and that would cause main() to exit
 		// immediately.
 	}
+	for _, p := range pollers {
+		p.halt()
+	}
 }
 
+// rediscover looks for this node's services again, and brings the
+// pollers up to date with what it finds.
+func rediscover(wl *whiplash.WLConfig, pollers map[string]*poller) {
+	svcs, err := wl.Discover()
+	if err != nil {
+		log.Println("rediscovery failed:", err)
+		return
+	}
+	updatePollers(pollers, svcs)
+}
 
-// pingScvs, running on the ticker channel `tc`, polls each service on
-// this node. this is a basic check for being alive, based on doing a
-// version request. it then reports to the aggregator.
-func pingSvcs(svcs map[string]*whiplash.Svc, tc <-chan time.Time) {
-	// every tick...
-	for _ = range tc {
-		// loop over known services
-		log.Println("updating: ping")
-		for _, svc := range svcs {
-			// ping, then send data if there are no issues
-			svc.Ping()
-			if svc.Err != nil {
-				log.Println("ping failed:", svc.Core.Name, svc.Err)
-				continue
-			}
-			sendData("ping", svc.Core.Name, &whiplash.ClientUpdate{
-				Time: time.Now().Unix(),
-				Svc: svc.Core,
-				Payload: nilPayload,
-			})
+// updatePollers stops the pollers of services which aren't in `svcs`
+// and starts pollers for services which are new, telling the
+// aggregator about each change.
+func updatePollers(pollers map[string]*poller, svcs map[string]*whiplash.Svc) {
+	cur := make(map[string]*whiplash.Svc, len(pollers))
+	for name, p := range pollers {
+		cur[name] = p.svc
+	}
+	added, removed := diffSvcs(cur, svcs)
+	for _, name := range removed {
+		// the poller has to stop before we can safely read its
+		// service
+		p := pollers[name]
+		p.halt()
+		delete(pollers, name)
+		log.Println("service removed:", name)
+		sendData("removed", name, &whiplash.ClientUpdate{
+			Time: time.Now().Unix(),
+			Svc: p.svc.Core,
+			Payload: nilPayload,
+		})
+	}
+	for _, name := range added {
+		svc := svcs[name]
+		log.Println("service added:", name)
+		sendData("added", name, &whiplash.ClientUpdate{
+			Time: time.Now().Unix(),
+			Svc: svc.Core,
+			Payload: nilPayload,
+		})
+		pollers[name] = startPoller(svc)
+	}
+}
+
+// diffSvcs compares the services being polled, `cur`, with the ones
+// just discovered, `found`, and returns the names of those which have
+// been added and removed, in sorted order. A service whose socket or
+// host has changed is a different service by the same name, so it
+// shows up in both lists.
+func diffSvcs(cur, found map[string]*whiplash.Svc) (added, removed []string) {
+	for name, svc := range cur {
+		fsvc, ok := found[name]
+		if !ok {
+			removed = append(removed, name)
+			continue
+		}
+		if fsvc.Sock != svc.Sock || fsvc.Core.Host != svc.Core.Host {
+			removed = append(removed, name)
+			added = append(added, name)
+		}
+	}
+	for name := range found {
+		if _, ok := cur[name]; !ok {
+			added = append(added, name)
 		}
 	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
 }
 
-// statSvcs performs a more in-depth status check on services. it
-// operates nearly identically to pingSvcs.
-func statSvcs(svcs map[string]*whiplash.Svc, tc <-chan time.Time) {
-	var statdata json.RawMessage
-	for _ = range tc {
-		log.Println("updating: stat")
-		for _, svc := range svcs {
-			statdata = svc.Stat()
-			// TODO handle MONs and RGWs
-			if svc.Err != nil {
-				log.Println("stat failed:", svc.Core.Name, svc.Err)
-				continue
-			}
-			sendData("stat", svc.Core.Name, &whiplash.ClientUpdate{
-				Time: time.Now().Unix(),
-				Svc: svc.Core,
-				Payload: statdata,
-			})
+// poller runs the checks for one service in its own goroutine, so
+// that services can be started and stopped independently.
+type poller struct {
+	svc *whiplash.Svc
+	// stop is closed to halt the poller
+	stop chan struct{}
+	// done is closed when the poller has halted
+	done chan struct{}
+}
+
+// startPoller launches a poller for `svc`.
+func startPoller(svc *whiplash.Svc) *poller {
+	p := &poller{svc: svc, stop: make(chan struct{}), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+// run pings the service right away, so that new services check in
+// promptly, and then pings and stats it on the chosen intervals until
+// halted.
+func (p *poller) run() {
+	defer close(p.done)
+	pingticker := time.NewTicker(time.Second * intvs[intv]["ping"])
+	defer pingticker.Stop()
+	statticker := time.NewTicker(time.Second * intvs[intv]["stat"])
+	defer statticker.Stop()
+	pingSvc(p.svc)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-pingticker.C:
+			pingSvc(p.svc)
+		case <-statticker.C:
+			statSvc(p.svc)
 		}
 	}
 }
 
+// halt stops the poller, and waits for it to finish whatever it was
+// in the middle of.
+func (p *poller) halt() {
+	close(p.stop)
+	<-p.done
+}
+
+// pingSvc is a basic check for a service being alive, based on doing
+// a version request. it then reports to the aggregator.
+func pingSvc(svc *whiplash.Svc) {
+	// ping, then send data if there are no issues
+	svc.Ping()
+	if svc.Err != nil {
+		log.Println("ping failed:", svc.Core.Name, svc.Err)
+		return
+	}
+	sendData("ping", svc.Core.Name, &whiplash.ClientUpdate{
+		Time: time.Now().Unix(),
+		Svc: svc.Core,
+		Payload: nilPayload,
+	})
+}
+
+// statSvc performs a more in-depth status check on a service. it
+// operates nearly identically to pingSvc.
+func statSvc(svc *whiplash.Svc) {
+	statdata := svc.Stat()
+	if svc.Err != nil {
+		log.Println("stat failed:", svc.Core.Name, svc.Err)
+		return
+	}
+	sendData("stat", svc.Core.Name, &whiplash.ClientUpdate{
+		Time: time.Now().Unix(),
+		Svc: svc.Core,
+		Payload: statdata,
+	})
+}
+
 // sendData handles the actual sending of data to the aggregator.
 func sendData(cmd, svc string, u *whiplash.ClientUpdate) {
 	// create a new aclient instance
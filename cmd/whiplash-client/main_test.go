@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+func TestDiffSvcs(t *testing.T) {
+	svc := func(name, host, sock string) *whiplash.Svc {
+		return &whiplash.Svc{Core: &whiplash.SvcCore{Name: name, Host: host}, Sock: sock}
+	}
+	cur := map[string]*whiplash.Svc{
+		"osd.1": svc("osd.1", "store1", "/run/ceph/ceph-osd.1.asok"),
+		"osd.2": svc("osd.2", "store1", "/run/ceph/ceph-osd.2.asok"),
+		"osd.3": svc("osd.3", "store1", "/run/ceph/ceph-osd.3.asok"),
+		"osd.4": svc("osd.4", "store1", "/run/ceph/ceph-osd.4.asok"),
+	}
+	found := map[string]*whiplash.Svc{
+		// unchanged
+		"osd.1": svc("osd.1", "store1", "/run/ceph/ceph-osd.1.asok"),
+		// moved into a container
+		"osd.3": svc("osd.3", "store1", "/run/ceph/fsid/ceph-osd.3.asok"),
+		// renamed host
+		"osd.4": svc("osd.4", "store1a", "/run/ceph/ceph-osd.4.asok"),
+		// new
+		"osd.5": svc("osd.5", "store1", "/run/ceph/ceph-osd.5.asok"),
+		"osd.0": svc("osd.0", "store1", "/run/ceph/ceph-osd.0.asok"),
+	}
+	added, removed := diffSvcs(cur, found)
+	if want := []string{"osd.0", "osd.3", "osd.4", "osd.5"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added should be %v but is %v", want, added)
+	}
+	if want := []string{"osd.2", "osd.3", "osd.4"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed should be %v but is %v", want, removed)
+	}
+	// nothing changes when nothing changes
+	added, removed = diffSvcs(cur, cur)
+	if added != nil || removed != nil {
+		t.Errorf("identical sets should give no changes; got %v, %v", added, removed)
+	}
+	// and everything is new at startup
+	added, removed = diffSvcs(nil, cur)
+	if len(added) != 4 || removed != nil {
+		t.Errorf("empty starting set should add everything; got %v, %v", added, removed)
+	}
+}
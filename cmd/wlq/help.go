@@ -6,19 +6,36 @@ var helptext = map[string]string{
 	"main": `wlq is the Whiplash query tool.
 Usage is: wlq <OPTS> [COMMAND] [SUBCOMMAND] <ARGS>
 
-There are two global options:
+Global options:
     -c [FILE] Path to whiplash config file (default: /etc/whiplash.conf)
     -j        Output JSON data instead of a formatted report
+    -s [KEY]  Sort report tables by name, used, avail, util, or pgs
+              (default: name)
+    -r        Reverse the sort order of report tables
 
 To see available commands, run wlq with no arguments.
 
 Do 'wlq help [COMMAND]' or 'wlq help [COMMAND] [SUBCOMMAND] for more detailed
 information on usage of the commands and their subcommands.`,
 	"crushreload": `The 'crushreload' command sends a request asking that the aggregator
-reload the CRUSH map and refresh its cache of that data.`,
+reload the CRUSH map and refresh its cache of that data. It reports how many
+buckets and OSDs are in the new map, and how many of them changed.`,
+	"lastseen": `Usage: wlq lastseen [SERVICE|NODE ...]
+The 'lastseen' command lists when the aggregator last received ping and stat
+updates from each service, and how long ago that was. Services which have
+gone quiet longest are listed first. With no arguments, all services are
+shown. Otherwise only the named services, and the services on the named
+nodes, are shown.`,
+	"where": `Usage: wlq where [SERVICE ...]
+The 'where' command shows the node each service is on, and its location in
+the CRUSH hierarchy. OSDs may be given by number. To list the services on a
+node, use 'wlq status node [NODENAME]'.`,
 	"status": `The 'status' command fetches information on current cluster status from
 the aggregator. By default this information is formatted and printed to the
-terminal as a report. To get raw data, pass wlq the -j option.
+terminal as a report, with services which are not reporting highlighted.
+Services the aggregator hasn't heard from recently are shown as LATE, then
+STALE, and finally GONE. To get raw data, pass wlq the -j option. Tables in
+reports can be sorted with the -s and -r options.
 
 To do anything useful, a subcommand must be specified. Available subcommands:
     cluster
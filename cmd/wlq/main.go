@@ -15,6 +15,8 @@ import (
 var (
 	whipconf string
 	dumpjson bool
+	sortkey string
+	sortrev bool
 	commands *gaot.Node
 	args []string
 )
@@ -23,9 +25,13 @@ func init() {
 	// setup options vars
 	flag.StringVar(&whipconf, "c", "/etc/whiplash.conf", "Whiplash configuration file")
 	flag.BoolVar(&dumpjson, "j", false, "Output query response as raw JSON")
+	flag.StringVar(&sortkey, "s", "name", "Sort report tables by: "+strings.Join(sortkeys, ", "))
+	flag.BoolVar(&sortrev, "r", false, "Reverse the sort order of report tables")
 	// load up command structure into trie
 	commands = gaot.NewFromString("status")
 	commands.InsertString("crushreload")
+	commands.InsertString("lastseen")
+	commands.InsertString("where")
 	commands.InsertString("version")
 	commands.InsertString("help")
 	cmdtail := commands.FindString("status")
@@ -98,10 +104,23 @@ func main() {
 	}
 
 	// else, we have to hand off to a pretty-printing routine
-	// TODO write a pretty-printing routine
+	err = report(os.Stdout, resp)
+	if err != nil {
+		quit(err)
+	}
 }
 
 func validateInput() error {
+	// check the sort key
+	known := false
+	for _, k := range sortkeys {
+		if sortkey == k {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown sort key: '%s'\n\tknown sort keys: %s", sortkey, strings.Join(sortkeys, ", "))
+	}
 	// get list of top-level completions (commands)
 	cmdlist := commands.FirstCompletions()
 	// get our arguments
@@ -173,6 +192,10 @@ func showHelp() {
 		fmt.Println(helptext["version"])
 	case "crushreload":
 		fmt.Println(helptext["crushreload"])
+	case "lastseen":
+		fmt.Println(helptext["lastseen"])
+	case "where":
+		fmt.Println(helptext["where"])
 	case "status":
 		if len(args) == 2 {
 			fmt.Println(helptext["status"])
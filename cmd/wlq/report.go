@@ -0,0 +1,386 @@
+package main
+
+// This file contains the pretty-printing routines which turn query
+// responses into reports.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+var (
+	// terminal escapes for highlighting
+	hlOn  = "\x1b[1;31m"
+	hlOff = "\x1b[0m"
+	// sort keys which can be passed to -s
+	sortkeys = []string{"name", "used", "avail", "util", "pgs"}
+)
+
+// report dispatches a query response to the appropriate printing
+// routine.
+func report(w io.Writer, resp *whiplash.QueryResponse) error {
+	var err error
+	switch resp.Cmd {
+	case "status":
+		switch resp.Subcmd {
+		case "cluster":
+			cr := &whiplash.ClusterReport{}
+			if err = json.Unmarshal(resp.Data, cr); err == nil {
+				reportCluster(w, cr)
+			}
+		case "rack":
+			rr := &whiplash.RackReport{}
+			if err = json.Unmarshal(resp.Data, rr); err == nil {
+				reportRack(w, rr)
+			}
+		case "node":
+			nr := &whiplash.NodeReport{}
+			if err = json.Unmarshal(resp.Data, nr); err == nil {
+				reportNode(w, nr)
+			}
+		case "osd":
+			or := &whiplash.OsdReport{}
+			if err = json.Unmarshal(resp.Data, or); err == nil {
+				reportOsd(w, or)
+			}
+		default:
+			err = fmt.Errorf("don't know how to print 'status %s'", resp.Subcmd)
+		}
+	case "lastseen":
+		ls := &whiplash.LastSeenReport{}
+		if err = json.Unmarshal(resp.Data, ls); err == nil {
+			reportLastSeen(w, ls)
+		}
+	case "where":
+		var wrs []*whiplash.WhereReport
+		if err = json.Unmarshal(resp.Data, &wrs); err == nil {
+			reportWhere(w, wrs)
+		}
+	case "crushreload":
+		cr := &whiplash.CrushReloadReport{}
+		if err = json.Unmarshal(resp.Data, cr); err == nil {
+			fmt.Fprintf(w, "CRUSH map reloaded: %d buckets (%d changed), %d OSDs (%d changed)\n",
+				cr.Buckets, cr.BucketsChanged, cr.Osds, cr.OsdsChanged)
+		}
+	default:
+		// no report for this command; just show the data
+		fmt.Fprintln(w, string(resp.Data))
+	}
+	return err
+}
+
+// reportCluster prints the 'status cluster' report.
+func reportCluster(w io.Writer, cr *whiplash.ClusterReport) {
+	fmt.Fprintf(w, "MONs: %s\n", reporting(cr.MonsReporting, cr.Mons))
+	fmt.Fprintf(w, "RGWs: %s\n", reporting(cr.RgwsReporting, cr.Rgws))
+	reportSummary(w, &cr.CapacityReport)
+	if len(cr.Racks) > 0 {
+		fmt.Fprintln(w, "")
+		reportCapacityTable(w, "RACK", cr.Racks)
+	}
+	if len(cr.Hosts) > 0 {
+		fmt.Fprintln(w, "")
+		reportCapacityTable(w, "NODE", cr.Hosts)
+	}
+}
+
+// reportRack prints the 'status rack' report.
+func reportRack(w io.Writer, rr *whiplash.RackReport) {
+	fmt.Fprintf(w, "Rack: %s\n", rr.Name)
+	reportSummary(w, &rr.CapacityReport)
+	if len(rr.Hosts) > 0 {
+		fmt.Fprintln(w, "")
+		reportCapacityTable(w, "NODE", rr.Hosts)
+	}
+}
+
+// reportNode prints the 'status node' report.
+func reportNode(w io.Writer, nr *whiplash.NodeReport) {
+	fmt.Fprintf(w, "Node: %s\n", nr.Name)
+	reportSummary(w, &nr.CapacityReport)
+	fmt.Fprintln(w, "")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tTYPE\tVERSION\tSTATUS")
+	for _, svc := range nr.Svcs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", svc.Name, whiplash.SvcTypeName(svc.Type), svc.Version, svcStatus(svc))
+	}
+	tw.Flush()
+	if len(nr.OsdDetail) > 0 {
+		fmt.Fprintln(w, "")
+		reportOsdTable(w, nr.OsdDetail)
+	}
+}
+
+// reportOsd prints the 'status osd' report.
+func reportOsd(w io.Writer, or *whiplash.OsdReport) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "OSD:\t%s\n", or.Svc.Name)
+	fmt.Fprintf(tw, "Node:\t%s\n", or.Svc.Host)
+	fmt.Fprintf(tw, "Version:\t%s\n", or.Svc.Version)
+	fmt.Fprintf(tw, "Status:\t%s\n", svcStatus(or.Svc))
+	fmt.Fprintf(tw, "Last ping:\t%s\n", age(or.LastPing))
+	fmt.Fprintf(tw, "Last stat:\t%s\n", age(or.LastStat))
+	if or.Stat != nil {
+		st := or.Stat
+		fmt.Fprintf(tw, "Weight:\t%.3f\n", st.Weight)
+		fmt.Fprintf(tw, "Reweight:\t%.3f\n", st.Reweight)
+		fmt.Fprintf(tw, "Used:\t%s\n", humanBytes(st.BytesUsed))
+		fmt.Fprintf(tw, "Avail:\t%s\n", humanBytes(st.BytesAvail))
+		fmt.Fprintf(tw, "Size:\t%s\n", humanBytes(st.BytesTotal))
+		fmt.Fprintf(tw, "Util:\t%s\n", pct(st.BytesUsed, st.BytesTotal))
+		fmt.Fprintf(tw, "PGs:\t%d (%d primary, %d replica)\n", st.PgPrimary+st.PgReplica, st.PgPrimary, st.PgReplica)
+		fmt.Fprintf(tw, "Latency:\t%.1fms read, %.1fms write, %.1fms rmw\n",
+			st.ReadLatency*1000, st.WriteLatency*1000, st.RWLatency*1000)
+		fmt.Fprintf(tw, "IOPS:\t%.1f (%.1f read, %.1f write, %.1f rmw)\n",
+			st.OpRate, st.ReadOpRate, st.WriteOpRate, st.RWOpRate)
+		fmt.Fprintf(tw, "Throughput:\t%s/s in, %s/s out\n",
+			humanBytes(int(st.InBytesRate)), humanBytes(int(st.OutBytesRate)))
+		fmt.Fprintf(tw, "Recovery:\t%.1f ops/s\n", st.RecoveryOpRate)
+	}
+	tw.Flush()
+}
+
+// reportLastSeen prints the 'lastseen' report. It keeps the
+// aggregator's ordering, which is least recently heard from first.
+func reportLastSeen(w io.Writer, ls *whiplash.LastSeenReport) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tNODE\tLAST PING\tAGE\tLAST STAT\tAGE\tSTATUS")
+	for _, sr := range ls.Svcs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", sr.Svc.Name, sr.Svc.Host,
+			timestamp(sr.LastPing), ageAt(ls.Time, sr.LastPing),
+			timestamp(sr.LastStat), ageAt(ls.Time, sr.LastStat), svcStatus(sr.Svc))
+	}
+	tw.Flush()
+}
+
+// reportWhere prints the 'where' report. CRUSH locations are shown as
+// type=name pairs, sorted by type.
+func reportWhere(w io.Writer, wrs []*whiplash.WhereReport) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tNODE\tLOCATION")
+	for _, wr := range wrs {
+		loc := "-"
+		if len(wr.Location) > 0 {
+			types := make([]string, 0, len(wr.Location))
+			for typ := range wr.Location {
+				types = append(types, typ)
+			}
+			sort.Strings(types)
+			chunks := make([]string, len(types))
+			for i, typ := range types {
+				chunks[i] = typ + "=" + wr.Location[typ]
+			}
+			loc = strings.Join(chunks, " ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", wr.Svc, wr.Host, loc)
+	}
+	tw.Flush()
+}
+
+// reportSummary prints the totals of a CapacityReport.
+func reportSummary(w io.Writer, c *whiplash.CapacityReport) {
+	fmt.Fprintf(w, "OSDs: %s\n", reporting(c.OsdsReporting, c.Osds))
+	fmt.Fprintf(w, "Capacity: %s used, %s avail, %s total (%s)\n",
+		humanBytes(c.BytesUsed), humanBytes(c.BytesAvail),
+		humanBytes(c.BytesTotal), pct(c.BytesUsed, c.BytesTotal))
+	fmt.Fprintf(w, "PGs: %d primary, %d replica\n", c.PgPrimary, c.PgReplica)
+}
+
+// reportCapacityTable prints a table of CapacityReports, with `label`
+// as the heading of the name column.
+func reportCapacityTable(w io.Writer, label string, crs []*whiplash.CapacityReport) {
+	sortCapacity(crs)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tUSED\tAVAIL\tSIZE\tUTIL\tPGS\tOSDS\n", label)
+	for _, c := range crs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", c.Name, humanBytes(c.BytesUsed),
+			humanBytes(c.BytesAvail), humanBytes(c.BytesTotal),
+			pct(c.BytesUsed, c.BytesTotal), c.PgPrimary+c.PgReplica,
+			reporting(c.OsdsReporting, c.Osds))
+	}
+	tw.Flush()
+}
+
+// reportOsdTable prints a table of OsdReports.
+func reportOsdTable(w io.Writer, ors []*whiplash.OsdReport) {
+	sortOsds(ors)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OSD\tWEIGHT\tREWEIGHT\tUSED\tAVAIL\tUTIL\tPGS\tLAST STAT\tSTATUS")
+	for _, or := range ors {
+		if or.Stat == nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\t%s\t%s\n", or.Svc.Name, age(or.LastStat), svcStatus(or.Svc))
+			continue
+		}
+		st := or.Stat
+		fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%s\t%s\t%s\t%d\t%s\t%s\n", or.Svc.Name, st.Weight,
+			st.Reweight, humanBytes(st.BytesUsed), humanBytes(st.BytesAvail), pct(st.BytesUsed, st.BytesTotal),
+			st.PgPrimary+st.PgReplica, age(or.LastStat), svcStatus(or.Svc))
+	}
+	tw.Flush()
+}
+
+// sortCapacity sorts CapacityReports according to the -s and -r
+// options.
+func sortCapacity(crs []*whiplash.CapacityReport) {
+	less := func(i, j int) bool {
+		a, b := crs[i], crs[j]
+		switch sortkey {
+		case "used":
+			return a.BytesUsed < b.BytesUsed
+		case "avail":
+			return a.BytesAvail < b.BytesAvail
+		case "util":
+			return util(a.BytesUsed, a.BytesTotal) < util(b.BytesUsed, b.BytesTotal)
+		case "pgs":
+			return a.PgPrimary+a.PgReplica < b.PgPrimary+b.PgReplica
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(crs, func(i, j int) bool {
+		if sortrev {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+// sortOsds sorts OsdReports according to the -s and -r options. OSDs
+// without stat data sort as if empty.
+func sortOsds(ors []*whiplash.OsdReport) {
+	stat := func(i int) *whiplash.OsdStat {
+		if ors[i].Stat == nil {
+			return &whiplash.OsdStat{}
+		}
+		return ors[i].Stat
+	}
+	less := func(i, j int) bool {
+		a, b := stat(i), stat(j)
+		switch sortkey {
+		case "used":
+			return a.BytesUsed < b.BytesUsed
+		case "avail":
+			return a.BytesAvail < b.BytesAvail
+		case "util":
+			return util(a.BytesUsed, a.BytesTotal) < util(b.BytesUsed, b.BytesTotal)
+		case "pgs":
+			return a.PgPrimary+a.PgReplica < b.PgPrimary+b.PgReplica
+		}
+		return osdNum(ors[i].Svc.Name) < osdNum(ors[j].Svc.Name)
+	}
+	sort.SliceStable(ors, func(i, j int) bool {
+		if sortrev {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+// osdNum returns the numeric ID of an OSD name like "osd.12".
+func osdNum(name string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(name, "osd."))
+	return n
+}
+
+// humanBytes formats a byte count using binary units.
+func humanBytes(b int) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	f := float64(b)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", b, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+// util returns the utilisation ratio of an OSD or group of OSDs. It
+// is the same calculation as OsdStat.FillRatio, so that OSDs and
+// their rollups agree.
+func util(used, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total)
+}
+
+// pct formats utilisation as a percentage.
+func pct(used, total int) string {
+	return fmt.Sprintf("%.1f%%", util(used, total)*100)
+}
+
+// age formats a timestamp as time elapsed since then.
+func age(ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return time.Since(time.Unix(ts, 0)).Truncate(time.Second).String() + " ago"
+}
+
+// ageAt formats a timestamp as time elapsed since then, as of `now`.
+func ageAt(now, ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return (time.Duration(now-ts) * time.Second).String()
+}
+
+// timestamp formats a timestamp as local time.
+func timestamp(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+}
+
+// reporting formats a count of reporting services, highlighting it if
+// some are not reporting.
+func reporting(up, total int) string {
+	s := fmt.Sprintf("%d/%d reporting", up, total)
+	if up < total {
+		return highlight(s)
+	}
+	return s
+}
+
+// svcStatus describes whether a service is reporting, and whether
+// the aggregator has heard from it recently.
+func svcStatus(svc *whiplash.SvcCore) string {
+	switch {
+	case svc.State != "" && svc.State != whiplash.SvcUp:
+		return highlight(strings.ToUpper(svc.State))
+	case !svc.Reporting:
+		return highlight("NOT REPORTING")
+	}
+	return "ok"
+}
+
+// highlight wraps `s` in terminal escapes when stdout is a
+// terminal. Highlighted text always goes in the last column of a
+// table, so the escapes don't throw off alignment.
+func highlight(s string) string {
+	if !isTerminal(os.Stdout) {
+		return s
+	}
+	return hlOn + s + hlOff
+}
+
+// isTerminal reports whether `f` is a character device.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
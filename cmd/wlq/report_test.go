@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sboyettedh/whiplash"
+)
+
+const (
+	gib = 1 << 30
+	tib = 1 << 40
+)
+
+// stdoutTo points os.Stdout, which decides whether output gets
+// highlighted, at the named file (or a temp file if name is empty),
+// and returns a func which puts it back.
+func stdoutTo(t *testing.T, name string) func() {
+	var f *os.File
+	var err error
+	if name == "" {
+		f, err = ioutil.TempFile("", "wlq")
+	} else {
+		f, err = os.OpenFile(name, os.O_WRONLY, 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = f
+	return func() {
+		os.Stdout = orig
+		f.Close()
+		if name == "" {
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// render runs data through report as the response to cmd/subcmd
+// and returns what was printed.
+func render(cmd, subcmd string, data interface{}) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = report(buf, &whiplash.QueryResponse{Code: 200, Cmd: cmd, Subcmd: subcmd, Data: b})
+	return buf.String(), err
+}
+
+var reportTests = []struct {
+	cmd, subcmd string
+	data        interface{}
+	want        string
+}{
+	{"status", "cluster", &whiplash.ClusterReport{
+		CapacityReport: whiplash.CapacityReport{Name: "cluster", Osds: 3, OsdsReporting: 2,
+			BytesUsed: 3 * tib, BytesAvail: tib, BytesTotal: 4 * tib, PgPrimary: 100, PgReplica: 200},
+		Mons: 3, MonsReporting: 3, Rgws: 1,
+		Racks: []*whiplash.CapacityReport{
+			{Name: "r2", Osds: 1, BytesUsed: tib, BytesAvail: tib, BytesTotal: 2 * tib, PgPrimary: 40, PgReplica: 80},
+			{Name: "r1", Osds: 2, OsdsReporting: 2, BytesUsed: 2 * tib, BytesTotal: 2 * tib, PgPrimary: 60, PgReplica: 120},
+		},
+		Hosts: []*whiplash.CapacityReport{
+			{Name: "h1", Osds: 2, OsdsReporting: 2, BytesUsed: 2 * tib, BytesTotal: 2 * tib, PgPrimary: 60, PgReplica: 120},
+		},
+	}, `MONs: 3/3 reporting
+RGWs: 0/1 reporting
+OSDs: 2/3 reporting
+Capacity: 3.0TiB used, 1.0TiB avail, 4.0TiB total (75.0%)
+PGs: 100 primary, 200 replica
+
+RACK  USED    AVAIL   SIZE    UTIL    PGS  OSDS
+r1    2.0TiB  0B      2.0TiB  100.0%  180  2/2 reporting
+r2    1.0TiB  1.0TiB  2.0TiB  50.0%   120  0/1 reporting
+
+NODE  USED    AVAIL  SIZE    UTIL    PGS  OSDS
+h1    2.0TiB  0B     2.0TiB  100.0%  180  2/2 reporting
+`},
+	{"status", "rack", &whiplash.RackReport{
+		CapacityReport: whiplash.CapacityReport{Name: "r1", Osds: 2, OsdsReporting: 2,
+			BytesUsed: 512 * gib, BytesAvail: 1536 * gib, BytesTotal: 2048 * gib},
+		Hosts: []*whiplash.CapacityReport{
+			{Name: "h2", Osds: 1, OsdsReporting: 1, BytesUsed: 512 * gib, BytesAvail: 512 * gib, BytesTotal: 1024 * gib},
+			{Name: "h1", Osds: 1, OsdsReporting: 1, BytesAvail: 1024 * gib, BytesTotal: 1024 * gib},
+		},
+	}, `Rack: r1
+OSDs: 2/2 reporting
+Capacity: 512.0GiB used, 1.5TiB avail, 2.0TiB total (25.0%)
+PGs: 0 primary, 0 replica
+
+NODE  USED      AVAIL     SIZE    UTIL   PGS  OSDS
+h1    0B        1.0TiB    1.0TiB  0.0%   0    1/1 reporting
+h2    512.0GiB  512.0GiB  1.0TiB  50.0%  0    1/1 reporting
+`},
+	// some space is reserved, so used + avail is less than the size,
+	// and the node and its OSD have to agree on utilisation
+	{"status", "node", &whiplash.NodeReport{
+		CapacityReport: whiplash.CapacityReport{Name: "h1", Osds: 2, OsdsReporting: 1,
+			BytesUsed: gib, BytesAvail: 5 * gib / 2, BytesTotal: 4 * gib, PgPrimary: 5, PgReplica: 7},
+		Svcs: []*whiplash.SvcCore{
+			{Name: "mon.a", Type: whiplash.MON, Version: "12.2.0", Reporting: true, State: whiplash.SvcLate},
+			{Name: "osd.9", Type: whiplash.OSD, Version: "12.2.0"},
+			{Name: "osd.10", Type: whiplash.OSD, Version: "12.2.0", Reporting: true, State: whiplash.SvcUp},
+		},
+		OsdDetail: []*whiplash.OsdReport{
+			{Svc: &whiplash.SvcCore{Name: "osd.10", Type: whiplash.OSD, Reporting: true},
+				Stat: &whiplash.OsdStat{Weight: 1.82, Reweight: 1, BytesUsed: gib, BytesAvail: 5 * gib / 2,
+					BytesTotal: 4 * gib, FillRatio: 0.25, PgPrimary: 5, PgReplica: 7}},
+			{Svc: &whiplash.SvcCore{Name: "osd.9", Type: whiplash.OSD}},
+		},
+	}, `Node: h1
+OSDs: 1/2 reporting
+Capacity: 1.0GiB used, 2.5GiB avail, 4.0GiB total (25.0%)
+PGs: 5 primary, 7 replica
+
+SERVICE  TYPE  VERSION  STATUS
+mon.a    mon   12.2.0   LATE
+osd.9    osd   12.2.0   NOT REPORTING
+osd.10   osd   12.2.0   ok
+
+OSD     WEIGHT  REWEIGHT  USED    AVAIL   UTIL   PGS  LAST STAT  STATUS
+osd.9   -       -         -       -       -      -    never      NOT REPORTING
+osd.10  1.820   1.000     1.0GiB  2.5GiB  25.0%  12   never      ok
+`},
+	{"status", "osd", &whiplash.OsdReport{
+		Svc: &whiplash.SvcCore{Name: "osd.10", Type: whiplash.OSD, Host: "h1", Version: "12.2.0",
+			Reporting: true, State: whiplash.SvcStale},
+		Stat: &whiplash.OsdStat{Weight: 1.82, Reweight: 0.9, BytesUsed: gib, BytesAvail: 3 * gib,
+			BytesTotal: 4 * gib, FillRatio: 0.25, PgPrimary: 5, PgReplica: 7,
+			ReadLatency: 0.0015, WriteLatency: 0.004, RWLatency: 0.01,
+			OpRate: 30, ReadOpRate: 20, WriteOpRate: 9.5, RWOpRate: 0.5,
+			InBytesRate: 2048, OutBytesRate: 1536, RecoveryOpRate: 1.5},
+	}, `OSD:         osd.10
+Node:        h1
+Version:     12.2.0
+Status:      STALE
+Last ping:   never
+Last stat:   never
+Weight:      1.820
+Reweight:    0.900
+Used:        1.0GiB
+Avail:       3.0GiB
+Size:        4.0GiB
+Util:        25.0%
+PGs:         12 (5 primary, 7 replica)
+Latency:     1.5ms read, 4.0ms write, 10.0ms rmw
+IOPS:        30.0 (20.0 read, 9.5 write, 0.5 rmw)
+Throughput:  2.0KiB/s in, 1.5KiB/s out
+Recovery:    1.5 ops/s
+`},
+	// no stat yet: just the service details
+	{"status", "osd", &whiplash.OsdReport{
+		Svc: &whiplash.SvcCore{Name: "osd.11", Type: whiplash.OSD, Host: "h1", Version: "12.2.0"},
+	}, `OSD:        osd.11
+Node:       h1
+Version:    12.2.0
+Status:     NOT REPORTING
+Last ping:  never
+Last stat:  never
+`},
+	{"lastseen", "", &whiplash.LastSeenReport{
+		Time: 1500000000,
+		Svcs: []*whiplash.SvcReport{
+			{Svc: &whiplash.SvcCore{Name: "osd.2", Host: "h1", State: whiplash.SvcStale}, LastPing: 1499999000},
+			{Svc: &whiplash.SvcCore{Name: "osd.1", Host: "h1", Reporting: true},
+				LastPing: 1499999990, LastStat: 1499999700},
+		},
+	}, `SERVICE  NODE  LAST PING            AGE     LAST STAT            AGE    STATUS
+osd.2    h1    2017-07-14 02:23:20  16m40s  -                    never  STALE
+osd.1    h1    2017-07-14 02:39:50  10s     2017-07-14 02:35:00  5m0s   ok
+`},
+	{"where", "", []*whiplash.WhereReport{
+		{Svc: "osd.1", Host: "h1", Location: map[string]string{"root": "default", "rack": "r1", "host": "h1"}},
+		{Svc: "mon.a", Host: "m1"},
+	}, `SERVICE  NODE  LOCATION
+osd.1    h1    host=h1 rack=r1 root=default
+mon.a    m1    -
+`},
+	{"crushreload", "", &whiplash.CrushReloadReport{Buckets: 9, BucketsChanged: 1, Osds: 5, OsdsChanged: 2},
+		"CRUSH map reloaded: 9 buckets (1 changed), 5 OSDs (2 changed)\n"},
+	// commands without a report get their data printed as-is
+	{"echo", "", "hi there", "\"hi there\"\n"},
+}
+
+func TestReport(t *testing.T) {
+	defer stdoutTo(t, "")()
+	loc := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = loc }()
+
+	for _, rt := range reportTests {
+		out, err := render(rt.cmd, rt.subcmd, rt.data)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", rt.cmd, rt.subcmd, err)
+			continue
+		}
+		if out != rt.want {
+			t.Errorf("%s %s: report should be\n%s\nbut is\n%s", rt.cmd, rt.subcmd, rt.want, out)
+		}
+	}
+}
+
+func TestReportBad(t *testing.T) {
+	if _, err := render("status", "galaxy", struct{}{}); err == nil {
+		t.Error("unknown status subcommand should be an error")
+	}
+	for _, rt := range reportTests[:len(reportTests)-1] {
+		// every report wants an object or a list; a string is neither
+		if _, err := render(rt.cmd, rt.subcmd, "bogus"); err == nil {
+			t.Errorf("%s %s: malformed data should be an error", rt.cmd, rt.subcmd)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	restore := stdoutTo(t, "")
+	if s := highlight("GONE"); s != "GONE" {
+		t.Errorf("output to a file should not be highlighted but got %q", s)
+	}
+	if s := reporting(1, 2); s != "1/2 reporting" {
+		t.Errorf("output to a file should not be highlighted but got %q", s)
+	}
+	restore()
+
+	// /dev/null is a character device, so it looks like a terminal
+	defer stdoutTo(t, os.DevNull)()
+	if s := highlight("GONE"); s != hlOn+"GONE"+hlOff {
+		t.Errorf("output to a terminal should be highlighted but got %q", s)
+	}
+	if s := reporting(1, 2); s != hlOn+"1/2 reporting"+hlOff {
+		t.Errorf("partial reporting should be highlighted but got %q", s)
+	}
+	if s := reporting(2, 2); s != "2/2 reporting" {
+		t.Errorf("full reporting should not be highlighted but got %q", s)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{1<<20 - 1, "1024.0KiB"},
+		{5 * 1 << 20, "5.0MiB"},
+		{gib, "1.0GiB"},
+		{3 * tib / 2, "1.5TiB"},
+		{1 << 50, "1.0PiB"},
+		{1 << 62, "4.0EiB"},
+	}
+	for _, tt := range tests {
+		if s := humanBytes(tt.n); s != tt.want {
+			t.Errorf("humanBytes(%d) should be %q but is %q", tt.n, tt.want, s)
+		}
+	}
+}
+
+func TestPct(t *testing.T) {
+	tests := []struct {
+		used, total int
+		want        string
+	}{
+		{0, 0, "0.0%"},
+		{0, 10, "0.0%"},
+		{1, 2, "50.0%"},
+		{1, 4, "25.0%"},
+		{1234, 10000, "12.3%"},
+		{tib, tib, "100.0%"},
+	}
+	for _, tt := range tests {
+		if s := pct(tt.used, tt.total); s != tt.want {
+			t.Errorf("pct(%d, %d) should be %q but is %q", tt.used, tt.total, tt.want, s)
+		}
+	}
+}
+
+func TestAges(t *testing.T) {
+	if s := age(0); s != "never" {
+		t.Errorf("age(0) should be never but is %q", s)
+	}
+	if s := age(time.Now().Unix() - 3600); !strings.HasSuffix(s, " ago") {
+		t.Errorf("age should be some time ago but is %q", s)
+	}
+	if s := ageAt(100, 0); s != "never" {
+		t.Errorf("ageAt of 0 should be never but is %q", s)
+	}
+	if s := ageAt(100, 10); s != "1m30s" {
+		t.Errorf("ageAt should be 1m30s but is %q", s)
+	}
+	if s := timestamp(0); s != "-" {
+		t.Errorf("timestamp(0) should be - but is %q", s)
+	}
+}
+
+// sortFixture returns capacity reports which each come out in a
+// different order under each sort key.
+func sortFixture() []*whiplash.CapacityReport {
+	return []*whiplash.CapacityReport{
+		{Name: "b", BytesUsed: 3, BytesAvail: 1, BytesTotal: 4, PgPrimary: 1},
+		{Name: "c", BytesUsed: 1, BytesAvail: 9, BytesTotal: 10, PgPrimary: 3, PgReplica: 3},
+		{Name: "a", BytesUsed: 2, BytesAvail: 4, BytesTotal: 6, PgPrimary: 2},
+	}
+}
+
+func TestSortCapacity(t *testing.T) {
+	key, rev := sortkey, sortrev
+	defer func() { sortkey, sortrev = key, rev }()
+
+	want := map[string][]string{
+		"name":  {"a", "b", "c"},
+		"used":  {"c", "a", "b"},
+		"avail": {"b", "a", "c"},
+		"util":  {"c", "a", "b"},
+		"pgs":   {"b", "a", "c"},
+	}
+	if len(want) != len(sortkeys) {
+		t.Fatalf("sort keys have changed: %v", sortkeys)
+	}
+	for _, sortkey = range sortkeys {
+		for _, sortrev = range []bool{false, true} {
+			crs := sortFixture()
+			sortCapacity(crs)
+			var got []string
+			for _, cr := range crs {
+				got = append(got, cr.Name)
+			}
+			w := append([]string{}, want[sortkey]...)
+			if sortrev {
+				for i, j := 0, len(w)-1; i < j; i, j = i+1, j-1 {
+					w[i], w[j] = w[j], w[i]
+				}
+			}
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("-s %s (reversed: %v) should sort %v but got %v", sortkey, sortrev, w, got)
+			}
+		}
+	}
+}
+
+func TestSortOsds(t *testing.T) {
+	key, rev := sortkey, sortrev
+	defer func() { sortkey, sortrev = key, rev }()
+
+	osd := func(name string, st *whiplash.OsdStat) *whiplash.OsdReport {
+		return &whiplash.OsdReport{Svc: &whiplash.SvcCore{Name: name}, Stat: st}
+	}
+	fixture := func() []*whiplash.OsdReport {
+		return []*whiplash.OsdReport{
+			osd("osd.10", &whiplash.OsdStat{BytesUsed: 3, BytesAvail: 1, BytesTotal: 4, PgPrimary: 1}),
+			osd("osd.2", nil),
+			osd("osd.9", &whiplash.OsdStat{BytesUsed: 1, BytesAvail: 9, BytesTotal: 10, PgPrimary: 3, PgReplica: 3}),
+			osd("osd.1", &whiplash.OsdStat{BytesUsed: 2, BytesAvail: 4, BytesTotal: 6, PgPrimary: 2}),
+		}
+	}
+	// an OSD with no stat sorts as though it were empty
+	want := map[string][]string{
+		"name":  {"osd.1", "osd.2", "osd.9", "osd.10"},
+		"used":  {"osd.2", "osd.9", "osd.1", "osd.10"},
+		"avail": {"osd.2", "osd.10", "osd.1", "osd.9"},
+		"util":  {"osd.2", "osd.9", "osd.1", "osd.10"},
+		"pgs":   {"osd.2", "osd.10", "osd.1", "osd.9"},
+	}
+	for _, sortkey = range sortkeys {
+		for _, sortrev = range []bool{false, true} {
+			ors := fixture()
+			sortOsds(ors)
+			var got []string
+			for _, or := range ors {
+				got = append(got, or.Svc.Name)
+			}
+			w := append([]string{}, want[sortkey]...)
+			if sortrev {
+				for i, j := 0, len(w)-1; i < j; i, j = i+1, j-1 {
+					w[i], w[j] = w[j], w[i]
+				}
+			}
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("-s %s (reversed: %v) should sort %v but got %v", sortkey, sortrev, w, got)
+			}
+		}
+	}
+}
@@ -1,12 +1,10 @@
 package whiplash
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"strings"
+	"net/url"
 )
 
 // WLConfig is the overall Whiplash configuration.
@@ -42,13 +40,122 @@ type WLAggConfig struct {
 	Timeout int64 `json:"timeout"`
 	// QTimeout sets the Asock.Config Timeout parameter for wlq
 	QTimeout int64 `json:"qtimeout"`
+	// CrushFile, if set, is a JSON dump of 'ceph osd tree' to load
+	// the CRUSH map from, instead of running ceph. Mostly useful for
+	// testing.
+	CrushFile string `json:"crush_file"`
+	// HTTPPort is the port the HTTP listener (for /metrics and the
+	// JSON API) binds to. If empty, there is no HTTP listener.
+	HTTPPort string `json:"http_port"`
+	// CrushInterval is how often, in seconds, to automatically reload
+	// the CRUSH map. 0 disables automatic reloads.
+	CrushInterval int64 `json:"crush_interval"`
+	// Sinks configures where stat updates are forwarded to
+	Sinks WLSinksConfig `json:"sinks"`
+	// Staleness sets when services are considered late, stale, or
+	// gone
+	Staleness WLStaleConfig `json:"staleness"`
+}
+
+// WLStaleConfig sets the thresholds of the aggregator's service
+// liveness checks. All values are in seconds, and zero values get
+// defaults. A service becomes late or stale when either its ping or
+// stat updates are older than the matching threshold, and gone when
+// it hasn't sent an update of any kind for Gone seconds.
+type WLStaleConfig struct {
+	// Interval is how often services are checked. Defaults to 15.
+	Interval int64 `json:"interval"`
+	// PingLate defaults to 60
+	PingLate int64 `json:"ping_late"`
+	// PingStale defaults to 300
+	PingStale int64 `json:"ping_stale"`
+	// StatLate defaults to 900
+	StatLate int64 `json:"stat_late"`
+	// StatStale defaults to 1800
+	StatStale int64 `json:"stat_stale"`
+	// Gone defaults to 86400
+	Gone int64 `json:"gone"`
+}
+
+// WLSinksConfig configures the outputs which the aggregator forwards
+// stat updates to. Each sink is disabled unless it is configured.
+type WLSinksConfig struct {
+	// Graphite forwards stats to carbon, in plaintext format
+	Graphite *WLGraphiteConfig `json:"graphite"`
+	// Influx forwards stats to InfluxDB, in line protocol format
+	Influx *WLInfluxConfig `json:"influxdb"`
+}
+
+// WLSinkBufConfig holds the batching and buffering options shared by
+// all sinks.
+type WLSinkBufConfig struct {
+	// BatchSize is the most lines sent in a single write. Defaults
+	// to 500.
+	BatchSize int `json:"batch_size"`
+	// BufferSize is the most lines held in memory while the sink's
+	// endpoint is unreachable. When it is exceeded, the oldest lines
+	// are dropped. Defaults to 100000.
+	BufferSize int `json:"buffer_size"`
+	// FlushInterval is how often, in milliseconds, buffered lines
+	// are sent even if a full batch hasn't accumulated. Defaults to
+	// 1000.
+	FlushInterval int64 `json:"flush_interval"`
+	// MaxBackoff is the longest wait, in seconds, between attempts
+	// to reach the endpoint. Defaults to 60.
+	MaxBackoff int64 `json:"max_backoff"`
+}
+
+// WLGraphiteConfig is the Graphite sink configuration.
+type WLGraphiteConfig struct {
+	WLSinkBufConfig
+	// Addr is the host:port of the carbon plaintext listener
+	Addr string `json:"addr"`
+	// Prefix is the first component of every metric path. Defaults
+	// to "whiplash".
+	Prefix string `json:"prefix"`
+}
+
+// WLInfluxConfig is the InfluxDB sink configuration.
+type WLInfluxConfig struct {
+	WLSinkBufConfig
+	// URL is where to send points. For HTTP, this is the write
+	// endpoint, as in "http://influx:8086/write?db=ceph". For UDP,
+	// it is "udp://host:port".
+	URL string `json:"url"`
 }
 
 // WLCliConfig is the Whiplash agent configuration.
 type WLCliConfig struct {
-	// MsgLvl sets the Asock.Config Msglvl parameter. Valid: "all",
-	// "conn", "error", "fatal".
+	// Timeout is the network timeout, in milliseconds, used when
+	// talking to the aggregator and to Ceph admin sockets.
 	Timeout int64 `json:"timeout"`
+	// Counters is a whitelist of perf counters to ship to the
+	// aggregator, in addition to the standard stat data. Entries are
+	// shell patterns matched against "section.counter" names, such
+	// as "osd.op_r" or "bluestore.*".
+	Counters []string `json:"counters"`
+	// Discovery selects how the client finds the Ceph services on
+	// its machine: "conf" reads them from the Ceph configuration (the
+	// default), "sockets" looks for admin sockets in SocketDirs, and
+	// "both" does both.
+	Discovery string `json:"discovery"`
+	// SocketDirs are the directories searched for admin sockets, along
+	// with their immediate subdirectories. Defaults to /var/run/ceph.
+	SocketDirs []string `json:"socket_dirs"`
+	// Rediscover is how often, in seconds, the client looks for
+	// services which have been added or removed. SIGHUP also triggers
+	// a search. Defaults to 300; a negative value disables periodic
+	// searches.
+	Rediscover int64 `json:"rediscover"`
+	// Hostname is the name services on this machine are reported
+	// under, and is matched against "host" settings in the Ceph
+	// configuration to decide which daemons are local. Defaults to
+	// the system hostname, which matches in both short and
+	// fully-qualified forms.
+	Hostname string `json:"hostname"`
+	// HostAliases are other names this machine has in the Ceph
+	// configuration.
+	HostAliases []string `json:"host_aliases"`
 }
 
 // New returns a populated Whiplash configuration. `wlconf` is the
@@ -85,56 +192,66 @@ func (wlc *WLConfig) getConfig(wlconf string, gensvcs bool) (error) {
 	if wlc.Aggregator.BindPort == wlc.Aggregator.QueryPort {
 		return fmt.Errorf("BindPort and QueryPort can't have the same value")
 	}
+	hp := wlc.Aggregator.HTTPPort
+	if hp != "" && (hp == wlc.Aggregator.BindPort || hp == wlc.Aggregator.QueryPort) {
+		return fmt.Errorf("HTTPPort can't have the same value as BindPort or QueryPort")
+	}
+	if g := wlc.Aggregator.Sinks.Graphite; g != nil && g.Addr == "" {
+		return fmt.Errorf("Graphite sink configured with no address")
+	}
+	if i := wlc.Aggregator.Sinks.Influx; i != nil {
+		u, err := url.Parse(i.URL)
+		if err != nil {
+			return fmt.Errorf("InfluxDB sink URL: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp" {
+			return fmt.Errorf("InfluxDB sink URL must be http, https, or udp")
+		}
+	}
 	ml := wlc.Aggregator.MsgLvl
 	if ml != "all" && ml != "conn" && ml != "error" && ml != "fatal" {
 		return fmt.Errorf("Aggregator.Msglvl must be one of 'all', 'conn', 'error', 'fatal'")
 	}
+	dm := wlc.Client.Discovery
+	if dm != "" && dm != DiscoverConf && dm != DiscoverSockets && dm != DiscoverBoth {
+		return fmt.Errorf("Client.Discovery must be one of 'conf', 'sockets', 'both'")
+	}
 	if gensvcs {
-		wlc.CephConf, err = parseCephConf(wlc.CephConfLoc)
-		if err != nil {
-			return err
-		}
-		wlc.getCephServices()
+		return wlc.discover()
 	}
 	return nil
 }
 
-// parseCephConf reads a Ceph configuration file, and turns it into a
-// map of maps. The top-level map has the conf file section names as
-// keys. The second-level maps contain the key-value pairs of each
-// section of the configuration.
-func parseCephConf(cephconf string) (map[string]map[string]string, error) {
-	conffile, err := os.Open(cephconf)
+// Discover looks for the services on this machine again, re-reading
+// the Ceph configuration, and returns what it finds. wlc itself is
+// not changed.
+func (wlc *WLConfig) Discover() (map[string]*Svc, error) {
+	nwlc := *wlc
+	nwlc.Svcs = nil
+	err := nwlc.discover()
 	if err != nil {
 		return nil, err
 	}
-	defer conffile.Close()
-	cm := make(map[string]map[string]string)
-	confreader := bufio.NewReader(conffile)
-	confscanner := bufio.NewScanner(confreader)
-	section := ""
-	for confscanner.Scan() {
-		line := confscanner.Text()
-		line = strings.TrimSpace(line)
-		// skip comments
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-		// handle section markers
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			section = strings.Trim(line, "[]")
-			cm[section] = map[string]string{}
-			continue
-		}
-		// handle regular lines
-		chunks := strings.Split(line, " = ")
-		if len(chunks) < 2 {
-			chunks = strings.Split(line, "=")
-		}
-		if len(chunks) < 2 {
-			continue
-		}
-		cm[section][chunks[0]] = chunks[1]
+	return nwlc.Svcs, nil
+}
+
+// discover reads the Ceph configuration and populates wlc.Svcs, using
+// the configured discovery mode.
+func (wlc *WLConfig) discover() error {
+	var err error
+	wlc.CephConf, err = parseCephConf(wlc.CephConfLoc)
+	if err != nil {
+		return err
+	}
+	dm := wlc.Client.Discovery
+	if dm == "" || dm == DiscoverConf || dm == DiscoverBoth {
+		wlc.getCephServices()
+	}
+	if dm == DiscoverSockets || dm == DiscoverBoth {
+		wlc.getSocketServices()
 	}
-	return cm, nil
+	if wlc.Svcs == nil {
+		wlc.Svcs = make(map[string]*Svc)
+	}
+	return nil
 }
@@ -0,0 +1,130 @@
+package whiplash
+
+// This file contains discovery of Ceph services by their admin
+// sockets, for deployments (like cephadm and other container-based
+// setups) where ceph.conf doesn't list the daemons on each machine.
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service discovery modes, for WLCliConfig.Discovery.
+const (
+	DiscoverConf = "conf"
+	DiscoverSockets = "sockets"
+	DiscoverBoth = "both"
+)
+
+// defaultSocketDirs is where Ceph puts admin sockets unless told
+// otherwise.
+var defaultSocketDirs = []string{"/var/run/ceph"}
+
+// sockTypes maps the prefixes of daemon names to service types.
+var sockTypes = []struct {
+	prefix string
+	typ int
+}{
+	{"osd.", OSD},
+	{"mon.", MON},
+	{"client.radosgw.", RGW},
+	{"client.rgw.", RGW},
+}
+
+// getSocketServices scans the client's socket directories for admin
+// sockets, and adds a service to wlc.Svcs for each one which answers
+// a version request. Services which are already known are skipped.
+func (wlc *WLConfig) getSocketServices() {
+	if wlc.Svcs == nil {
+		wlc.Svcs = make(map[string]*Svc)
+	}
+	dirs := wlc.Client.SocketDirs
+	if len(dirs) == 0 {
+		dirs = defaultSocketDirs
+	}
+	host := wlc.hostNames()[0]
+	for _, sock := range findSockets(dirs) {
+		cluster, name, typ, ok := sockSvcName(sock)
+		if !ok {
+			continue
+		}
+		if _, ok := wlc.Svcs[name]; ok {
+			continue
+		}
+		if cluster == "" {
+			cluster = cephCluster(wlc.CephConfLoc)
+		}
+		// the conf may still know things about the daemon, even
+		// if it doesn't have a section for it
+		settings := cephDaemonConf(wlc.CephConf, cluster, host, name)
+		s := &Svc{Core: &SvcCore{Name: name, Type: typ, Host: host}, Sock: sock}
+		if settings["host"] != "" {
+			s.Core.Host = settings["host"]
+		}
+		if typ == MON {
+			s.data = settings["mon data"]
+		}
+		s.timeout = time.Duration(wlc.Client.Timeout) * time.Millisecond
+		s.counters = wlc.Client.Counters
+		// stale sockets are left behind by daemons which have died,
+		// so only take the ones which answer
+		s.Ping()
+		if !s.Core.Reporting {
+			continue
+		}
+		wlc.Svcs[name] = s
+	}
+}
+
+// findSockets returns the files in `dirs`, and in their immediate
+// subdirectories, which look like admin sockets. cephadm puts
+// sockets in a subdirectory named for the cluster's fsid.
+func findSockets(dirs []string) []string {
+	var socks []string
+	for _, dir := range dirs {
+		for _, pat := range []string{"*", filepath.Join("*", "*")} {
+			matches, _ := filepath.Glob(filepath.Join(dir, pat))
+			for _, m := range matches {
+				if fi, err := os.Stat(m); err != nil || fi.IsDir() {
+					continue
+				}
+				if _, _, _, ok := sockSvcName(m); ok {
+					socks = append(socks, m)
+				}
+			}
+		}
+	}
+	return socks
+}
+
+// sockSvcName infers the daemon behind the admin socket at `path`
+// from its filename, which Ceph makes from "$cluster-$name.asok" by
+// default. It returns the cluster name (if there is one), the
+// daemon's name and type, and whether the filename was recognized at
+// all.
+func sockSvcName(path string) (cluster, name string, typ int, ok bool) {
+	base := strings.TrimSuffix(filepath.Base(path), ".asok")
+	for i := 0; i < len(base); i++ {
+		// names start at the beginning, or after a separator
+		if i > 0 && base[i-1] != '-' && base[i-1] != '.' {
+			continue
+		}
+		for _, st := range sockTypes {
+			id := strings.TrimPrefix(base[i:], st.prefix)
+			if id == base[i:] || id == "" {
+				continue
+			}
+			if _, err := strconv.Atoi(id); st.typ == OSD && err != nil {
+				continue
+			}
+			if i > 0 && base[i-1] == '-' {
+				cluster = base[:i-1]
+			}
+			return cluster, base[i:], st.typ, true
+		}
+	}
+	return "", "", 0, false
+}
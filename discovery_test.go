@@ -0,0 +1,138 @@
+package whiplash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSockSvcName(t *testing.T) {
+	tests := []struct {
+		path, cluster, name string
+		typ int
+		ok bool
+	}{
+		{"./test_corpus/osdsocks/ceph-osd.9900.asok", "ceph", "osd.9900", OSD, true},
+		{"./test_corpus/monsocks/ceph-mon.peon9999.asok", "ceph", "mon.peon9999", MON, true},
+		{"./test_corpus/rgwsocks/radosgw.client.radosgw.peon9999", "", "client.radosgw.peon9999", RGW, true},
+		{"/var/run/ceph/fsid/ceph-client.rgw.site.host.abcdef.asok", "ceph", "client.rgw.site.host.abcdef", RGW, true},
+		{"/var/run/ceph/my-cluster-osd.12.asok", "my-cluster", "osd.12", OSD, true},
+		{"/var/run/ceph/ceph-osd.x.asok", "", "", 0, false},
+		{"/var/run/ceph/ceph-osd..asok", "", "", 0, false},
+		{"/var/run/ceph/ceph-mgr.a.asok", "", "", 0, false},
+		{"/var/run/ceph/ceph-client.admin.1234.asok", "", "", 0, false},
+		{"/var/run/ceph/xosd.1.asok", "", "", 0, false},
+	}
+	for _, test := range tests {
+		cluster, name, typ, ok := sockSvcName(test.path)
+		if cluster != test.cluster || name != test.name || typ != test.typ || ok != test.ok {
+			t.Errorf("%s: expected %q %q %d %v but got %q %q %d %v", test.path,
+				test.cluster, test.name, test.typ, test.ok, cluster, name, typ, ok)
+		}
+	}
+}
+
+func TestGetSocketServices(t *testing.T) {
+	// the fixture sockets are all found, but nothing is listening
+	// on them, so none should be added
+	c, err := New("./test_corpus/testsocks.config", true)
+	if err != nil {
+		t.Fatalf("Tried using testsocks.config file, but got: %v", err)
+	}
+	if n := len(findSockets(c.Client.SocketDirs)); n != 5 {
+		t.Errorf("should have found 5 sockets but found %d", n)
+	}
+	if len(c.Svcs) != 0 {
+		t.Errorf("dead sockets should have been ignored, but got %v", c.Svcs)
+	}
+
+	// now do it again with live sockets, copying the fixtures' layout
+	// (plus a cephadm-style subdirectory) into a tempdir
+	dir, err := ioutil.TempDir("", "wlsocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "fsid"), 0755)
+	vresp := map[string][]byte{"version": []byte(`{"version":"12.2.0"}`)}
+	for _, fixture := range []string{"osdsocks/ceph-osd.9900.asok", "osdsocks/ceph-osd.9901.asok",
+		"monsocks/ceph-mon.peon9999.asok", "rgwsocks/radosgw.client.radosgw.peon9999"} {
+		fa := newFakeAsock(t, filepath.Join(dir, filepath.Base(fixture)), vresp)
+		defer fa.close()
+	}
+	fa := newFakeAsock(t, filepath.Join(dir, "fsid", "ceph-osd.9903.asok"), vresp)
+	defer fa.close()
+	// a socket for something we don't monitor, and a dead one
+	fa = newFakeAsock(t, filepath.Join(dir, "ceph-mgr.peon9999.asok"), vresp)
+	defer fa.close()
+	ioutil.WriteFile(filepath.Join(dir, "ceph-osd.9904.asok"), nil, 0644)
+
+	c.Client.SocketDirs = []string{dir}
+	c.Svcs = nil
+	c.getSocketServices()
+	want := map[string]int{
+		"osd.9900": OSD,
+		"osd.9901": OSD,
+		"osd.9903": OSD,
+		"mon.peon9999": MON,
+		"client.radosgw.peon9999": RGW,
+	}
+	if len(c.Svcs) != len(want) {
+		t.Errorf("expected %d services but got %d: %v", len(want), len(c.Svcs), c.Svcs)
+	}
+	for name, typ := range want {
+		svc, ok := c.Svcs[name]
+		if !ok {
+			t.Errorf("should have found %s but did not", name)
+			continue
+		}
+		if svc.Core.Type != typ || !svc.Core.Reporting || svc.Core.Version != "12.2.0" {
+			t.Errorf("%s not as expected: %v", name, svc.Core)
+		}
+	}
+	// hosts come from the conf when it has them
+	if h := c.Svcs["osd.9900"].Core.Host; h != "cephstore9999" {
+		t.Errorf("osd.9900 should have host cephstore9999 but has %q", h)
+	}
+	if d := c.Svcs["mon.peon9999"].data; d != "/srv/ceph/mon.peon9999" {
+		t.Errorf("mon.peon9999 should have data /srv/ceph/mon.peon9999 but has %q", d)
+	}
+
+	// in "both" mode, the conf's services are kept as they are, and
+	// sockets only add to them
+	c.Svcs = nil
+	c.getCephServices()
+	c.getSocketServices()
+	if len(c.Svcs) != 6 {
+		t.Errorf("expected 6 services but got %d: %v", len(c.Svcs), c.Svcs)
+	}
+	if s := c.Svcs["osd.9902"].Sock; s != "./test_corpus/osdsocks/ceph-osd.9902.asok" {
+		t.Errorf("osd.9902 should be from the conf, but has sock %s", s)
+	}
+	// and Discover does the same, without touching c
+	c.Client.Discovery = DiscoverBoth
+	c.Svcs = nil
+	svcs, err := c.Discover()
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if len(svcs) != 6 || c.Svcs != nil {
+		t.Errorf("Discover should have found 6 services and left c alone; got %v, %v", svcs, c.Svcs)
+	}
+}
+
+func TestBadDiscovery(t *testing.T) {
+	f, err := ioutil.TempFile("", "wlconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"cephconf_loc": "./test_corpus/ceph.osd.conf",
+"aggregator": {"bind_addr": "127.0.0.1", "bind_port": "61089", "msglvl": "all"},
+"client": {"discovery": "magic"}}`)
+	f.Close()
+	if _, err := New(f.Name(), false); err == nil {
+		t.Errorf("discovery mode 'magic' should have been rejected")
+	}
+}
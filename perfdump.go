@@ -0,0 +1,210 @@
+package whiplash
+
+// This file contains a generic decoder for the output of 'perf dump',
+// which works on any section and counter of any daemon type, from
+// any Ceph release.
+//
+// 'perf dump' on its own doesn't say what a value means. A plain
+// number might be a gauge (the current number of PGs on an OSD) or a
+// monotonic counter (the number of ops ever handled), and an
+// {avgcount, sum} pair is a long-running average. 'perf schema' tells
+// us which is which, via a bitfield in each counter's "type"
+// field. Newer releases add "metric_type" and friends to the schema,
+// but "type" has been there all along, so that's what we use. If the
+// schema is missing or doesn't know about a counter, we fall back to
+// guessing from the shape of the value: numbers are gauges, and
+// objects with an avgcount are averages.
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+)
+
+// Bits of the "type" field in 'perf schema' output.
+const (
+	perfTime = 0x1
+	perfU64 = 0x2
+	perfLongRunAvg = 0x4
+	perfCounter = 0x8
+	perfHistogram = 0x10
+)
+
+// Delays before fetching a daemon's perf schema again after a failure.
+// The delay doubles with each failure, up to perfSchemaMaxRetry.
+const (
+	perfSchemaMinRetry = 30 * time.Second
+	perfSchemaMaxRetry = 30 * time.Minute
+)
+
+// Kinds of perf counter.
+const (
+	perfKindGauge = iota
+	perfKindCounter
+	perfKindAvg
+)
+
+// perfValue is a single decoded perf counter.
+type perfValue struct {
+	kind int
+	// val is the value of gauges and counters
+	val float64
+	// avg is the value of long-running averages
+	avg cephPerfAvg
+}
+
+// perfDump is a generically decoded 'perf dump', keyed by section
+// and then by counter name.
+type perfDump map[string]map[string]perfValue
+
+// perfSchema holds the type bits of every counter from 'perf
+// schema', keyed by section and then by counter name.
+type perfSchema map[string]map[string]int
+
+// parsePerfSchema decodes the output of 'perf schema'.
+func parsePerfSchema(b []byte) (perfSchema, error) {
+	var raw map[string]map[string]struct {
+		Type int `json:"type"`
+	}
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	ps := perfSchema{}
+	for sec, counters := range raw {
+		ps[sec] = map[string]int{}
+		for name, c := range counters {
+			ps[sec][name] = c.Type
+		}
+	}
+	return ps, nil
+}
+
+// parsePerfDump decodes the output of 'perf dump', using `schema` (which
+// may be nil) to classify counters. Values which are neither numbers
+// nor averages, such as histograms, are skipped.
+func parsePerfDump(b []byte, schema perfSchema) (perfDump, error) {
+	var raw map[string]map[string]json.RawMessage
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	pd := perfDump{}
+	for sec, counters := range raw {
+		pd[sec] = map[string]perfValue{}
+		for name, rv := range counters {
+			t, known := schema[sec][name]
+			if known && t&perfHistogram != 0 {
+				continue
+			}
+			var f float64
+			if json.Unmarshal(rv, &f) == nil {
+				pv := perfValue{kind: perfKindGauge, val: f}
+				if known && t&perfCounter != 0 {
+					pv.kind = perfKindCounter
+				}
+				pd[sec][name] = pv
+				continue
+			}
+			var obj map[string]json.RawMessage
+			if json.Unmarshal(rv, &obj) != nil {
+				continue
+			}
+			if _, ok := obj["avgcount"]; !ok {
+				continue
+			}
+			pv := perfValue{kind: perfKindAvg}
+			if json.Unmarshal(rv, &pv.avg) != nil {
+				continue
+			}
+			pd[sec][name] = pv
+		}
+	}
+	return pd, nil
+}
+
+// selectCounters returns the values of all counters whose names, in
+// "section.counter" form, match any of the shell patterns in
+// `patterns`. Gauges are reported as-is. Counters are reported as
+// per-second rates since `prev`, which was sampled `secs` seconds
+// earlier; they are omitted if there is no previous sample. Averages
+// are reported as the average over the interval since `prev`.
+func (pd perfDump) selectCounters(patterns []string, prev perfDump, secs float64) map[string]float64 {
+	out := map[string]float64{}
+	for sec, counters := range pd {
+		for name, pv := range counters {
+			key := sec + "." + name
+			if !perfMatch(patterns, key) {
+				continue
+			}
+			pp, havePrev := prev[sec][name]
+			switch pv.kind {
+			case perfKindGauge:
+				out[key] = pv.val
+			case perfKindCounter:
+				if !havePrev || secs <= 0 {
+					continue
+				}
+				d := pv.val - pp.val
+				if d < 0 {
+					// counter reset
+					d = pv.val
+				}
+				out[key] = d / secs
+			case perfKindAvg:
+				out[key] = pv.avg.Interval(pp.avg)
+			}
+		}
+	}
+	return out
+}
+
+// perfMatch reports whether `key` matches any of `patterns`.
+func perfMatch(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// perfCounters decodes a raw 'perf dump' and returns the values of the
+// counters selected by the service's counter whitelist. The schema is
+// fetched from the daemon the first time it's needed. If that fails,
+// counters are treated as gauges and the fetch is retried after a
+// backoff, rather than paying for a failed query on every stat. This
+// clobbers s.Resp.
+func (s *Svc) perfCounters(dump []byte) map[string]float64 {
+	if len(s.counters) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if s.schema == nil && !now.Before(s.schemaretry) {
+		err := s.Query("perf schema")
+		if err == nil {
+			s.schema, err = parsePerfSchema(s.Resp)
+		}
+		if err != nil {
+			if s.schemawait == 0 {
+				s.schemawait = perfSchemaMinRetry
+			} else {
+				s.schemawait *= 2
+			}
+			if s.schemawait > perfSchemaMaxRetry {
+				s.schemawait = perfSchemaMaxRetry
+			}
+			s.schemaretry = now.Add(s.schemawait)
+		} else {
+			s.schemawait = 0
+		}
+	}
+	pd, err := parsePerfDump(dump, s.schema)
+	if err != nil {
+		return nil
+	}
+	counters := pd.selectCounters(s.counters, s.pdlast, now.Sub(s.pdlastt).Seconds())
+	s.pdlast = pd
+	s.pdlastt = now
+	return counters
+}
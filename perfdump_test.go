@@ -0,0 +1,220 @@
+package whiplash
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func readPerf(t *testing.T, dumpfile, schemafile string) perfDump {
+	dump, err := ioutil.ReadFile(dumpfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema perfSchema
+	if schemafile != "" {
+		sb, err := ioutil.ReadFile(schemafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, err = parsePerfSchema(sb)
+		if err != nil {
+			t.Fatalf("couldn't parse %v: %v", schemafile, err)
+		}
+	}
+	pd, err := parsePerfDump(dump, schema)
+	if err != nil {
+		t.Fatalf("couldn't parse %v: %v", dumpfile, err)
+	}
+	return pd
+}
+
+func TestParsePerfDump(t *testing.T) {
+	_, err := parsePerfDump([]byte("not json"), nil)
+	if err == nil {
+		t.Errorf("parsing non-json should fail")
+	}
+	tests := []struct {
+		dump, schema string
+		sections int
+		kinds map[string]int
+	}{
+		// filestore, old-style schema
+		{"./test_corpus/perfdumps/osd.perfdump.json", "./test_corpus/perfdumps/osd.perfschema.json", 26,
+			map[string]int{"osd.op": perfKindCounter, "osd.numpg": perfKindGauge,
+				"osd.op_r_latency": perfKindAvg, "filestore.journal_latency": perfKindAvg,
+				"throttle-filestore_ops.val": perfKindGauge, "throttle-filestore_ops.get": perfKindCounter,
+				"mutex-WBThrottle::lock.wait": perfKindAvg}},
+		// bluestore, new-style schema
+		{"./test_corpus/perfdumps/osd.bluestore.perfdump.json", "./test_corpus/perfdumps/osd.bluestore.perfschema.json", 4,
+			map[string]int{"osd.op": perfKindCounter, "osd.stat_bytes_used": perfKindGauge,
+				"bluestore.kv_commit_lat": perfKindAvg, "bluestore.bluestore_onodes": perfKindGauge,
+				"bluefs.bytes_written_sst": perfKindCounter, "rocksdb.get_latency": perfKindAvg}},
+		// no schema: everything numeric is a gauge
+		{"./test_corpus/perfdumps/osd.bluestore.perfdump.json", "", 4,
+			map[string]int{"osd.op": perfKindGauge, "bluestore.kv_commit_lat": perfKindAvg}},
+	}
+	for _, test := range tests {
+		pd := readPerf(t, test.dump, test.schema)
+		if len(pd) != test.sections {
+			t.Errorf("%v: expected %v sections but got %v", test.dump, test.sections, len(pd))
+		}
+		for key, kind := range test.kinds {
+			var found bool
+			for sec, counters := range pd {
+				for name, pv := range counters {
+					if sec+"."+name == key {
+						found = true
+						if pv.kind != kind {
+							t.Errorf("%v: %v should be kind %v but is %v", test.dump, key, kind, pv.kind)
+						}
+					}
+				}
+			}
+			if !found {
+				t.Errorf("%v: %v not found", test.dump, key)
+			}
+		}
+	}
+}
+
+func TestSelectCounters(t *testing.T) {
+	sch := "./test_corpus/perfdumps/osd.bluestore.perfschema.json"
+	pd := readPerf(t, "./test_corpus/perfdumps/osd.bluestore.perfdump.json", sch)
+	patterns := []string{"osd.op", "osd.op_*_latency", "bluestore.bluestore_*", "nosuch.*"}
+	// first sample: counters are omitted, averages are lifetime
+	c := pd.selectCounters(patterns, nil, 0)
+	expected := map[string]float64{"osd.op_r_latency": 0.004, "osd.op_w_latency": 0.02,
+		"osd.op_rw_latency": 0.03, "bluestore.bluestore_allocated": 1500000000000,
+		"bluestore.bluestore_stored": 1400000000000, "bluestore.bluestore_compressed": 0,
+		"bluestore.bluestore_onodes": 123456}
+	for k, v := range expected {
+		if c[k] != v {
+			t.Errorf("%v should be %v but is %v", k, v, c[k])
+		}
+	}
+	// counters are the only things in bluestore_* besides gauges
+	if len(c) != len(expected) {
+		t.Errorf("expected %v counters but got %v: %v", len(expected), len(c), c)
+	}
+	// second sample: counters become rates
+	prev := readPerf(t, "./test_corpus/perfdumps/osd.bluestore.perfdump.json", sch)
+	pv := prev["osd"]["op"]
+	pv.val -= 5000
+	prev["osd"]["op"] = pv
+	pv = prev["osd"]["op_r_latency"]
+	pv.avg = cephPerfAvg{Avgcount: 110000, Sum: 470}
+	prev["osd"]["op_r_latency"] = pv
+	c = pd.selectCounters(patterns, prev, 10)
+	if c["osd.op"] != 500 {
+		t.Errorf("osd.op rate should be 500 but is %v", c["osd.op"])
+	}
+	if c["osd.op_r_latency"] != 0.001 {
+		t.Errorf("osd.op_r_latency should be 0.001 but is %v", c["osd.op_r_latency"])
+	}
+	// and a reset counter
+	pv = prev["osd"]["op"]
+	pv.val = 400000
+	prev["osd"]["op"] = pv
+	c = pd.selectCounters(patterns, prev, 10)
+	if c["osd.op"] != 20000 {
+		t.Errorf("reset osd.op rate should be 20000 but is %v", c["osd.op"])
+	}
+}
+
+func TestStatCounters(t *testing.T) {
+	pd, _ := ioutil.ReadFile("./test_corpus/perfdumps/osd.bluestore.perfdump.json")
+	ps, _ := ioutil.ReadFile("./test_corpus/perfdumps/osd.bluestore.perfschema.json")
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{"perf dump": pd, "perf schema": ps})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "osd.9900", Type: OSD}, Sock: fa.sock, timeout: 250 * time.Millisecond,
+		counters: []string{"bluestore.kv_*", "osd.op"}}
+	raw := s.Stat()
+	if s.Err != nil {
+		t.Fatalf("Stat failed: %v", s.Err)
+	}
+	if s.schema == nil {
+		t.Errorf("schema should have been fetched")
+	}
+	var stat OsdStat
+	json.Unmarshal(raw, &stat)
+	if len(stat.Counters) != 2 || stat.Counters["bluestore.kv_commit_lat"] != 0.003 {
+		t.Errorf("counters not as expected: %v", stat.Counters)
+	}
+	// the regular stat data should be unaffected
+	if stat.PgPrimary != 50 || stat.BytesUsed != 1500000000000 {
+		t.Errorf("stat data mangled: %+v", stat)
+	}
+	// second time around, osd.op is a rate
+	s.pdlastt = time.Now().Add(-10 * time.Second)
+	raw = s.Stat()
+	stat = OsdStat{}
+	json.Unmarshal(raw, &stat)
+	if r, ok := stat.Counters["osd.op"]; !ok || r != 0 {
+		t.Errorf("osd.op should have rate 0; got %v", stat.Counters)
+	}
+}
+
+func TestStatSchemaFailure(t *testing.T) {
+	pd, _ := ioutil.ReadFile("./test_corpus/perfdumps/osd.bluestore.perfdump.json")
+	ps, _ := ioutil.ReadFile("./test_corpus/perfdumps/osd.bluestore.perfschema.json")
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{
+		"perf dump": pd,
+		"perf schema": []byte("junk"),
+		"version": []byte(`{"version":"12.2.0"}`),
+	})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "osd.9900", Type: OSD}, Sock: fa.sock, timeout: 250 * time.Millisecond,
+		counters: []string{"bluestore.kv_*", "osd.op"}}
+	s.Ping()
+	// without a schema, the counters still come through, as gauges
+	raw := s.Stat()
+	if s.Err != nil {
+		t.Fatalf("Stat failed: %v", s.Err)
+	}
+	if s.schema != nil || s.schemawait != perfSchemaMinRetry || !s.schemaretry.After(time.Now()) {
+		t.Errorf("schema failure should have been recorded; retry in %v at %v", s.schemawait, s.schemaretry)
+	}
+	var stat OsdStat
+	json.Unmarshal(raw, &stat)
+	if _, ok := stat.Counters["osd.op"]; !ok {
+		t.Errorf("counters should fall back to gauges; got %v", stat.Counters)
+	}
+	// the schema isn't asked for again until the retry time
+	fa.resps["perf schema"] = ps
+	s.Stat()
+	if s.schema != nil {
+		t.Errorf("schema shouldn't have been fetched again before the retry time")
+	}
+	// each failure doubles the wait, up to the limit
+	fa.resps["perf schema"] = []byte("junk")
+	s.schemaretry = time.Now().Add(-time.Second)
+	s.Stat()
+	if s.schemawait != 2*perfSchemaMinRetry {
+		t.Errorf("retry wait should have doubled but is %v", s.schemawait)
+	}
+	s.schemawait = perfSchemaMaxRetry
+	s.schemaretry = time.Now().Add(-time.Second)
+	s.Stat()
+	if s.schemawait != perfSchemaMaxRetry {
+		t.Errorf("retry wait should be capped but is %v", s.schemawait)
+	}
+	// once the retry time passes, the schema is fetched
+	fa.resps["perf schema"] = ps
+	s.schemaretry = time.Now().Add(-time.Second)
+	s.Stat()
+	if s.schema == nil || s.schemawait != 0 {
+		t.Errorf("schema should have been fetched after the retry time")
+	}
+	// and a version change means fetching it again right away
+	s.schema = nil
+	s.schemawait = perfSchemaMinRetry
+	s.schemaretry = time.Now().Add(time.Hour)
+	fa.resps["version"] = []byte(`{"version":"12.2.1"}`)
+	s.Ping()
+	s.Stat()
+	if s.schema == nil || s.schemawait != 0 {
+		t.Errorf("schema should have been fetched after a version change")
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
-
-	"firepear.net/petrel"
+	"time"
 )
 
 // These are our Svc types, which are basically the types of ceph
@@ -17,37 +17,78 @@ const (
 	OSD
 )
 
-var (
-	// the list of admin socket commands we know
-	cephcmds = map[string][]byte{
-		"version": []byte("{\"prefix\":\"version\"}\000"),
-		"perf dump": []byte("{\"prefix\":\"perf dump\"}\000"),
+// SvcTypeName returns the name of a Svc type: "mon", "rgw", or "osd".
+func SvcTypeName(t int) string {
+	switch t {
+	case MON:
+		return "mon"
+	case RGW:
+		return "rgw"
+	case OSD:
+		return "osd"
 	}
-)
+	return "unknown"
+}
 
 // Svc represents a Ceph service
 type Svc struct {
 	Core *SvcCore
 	// Sock is the admin socket for the service
 	Sock string
+	// osdlast is the osd section of the previous OSD perf dump, for
+	// computing interval values
+	osdlast *cephOsdPerfDumpOsd
+	// osdlastt is when osdlast was sampled
+	osdlastt time.Time
+	// counters is the whitelist of perf counters to ship
+	counters []string
+	// schema is the daemon's perf schema
+	schema perfSchema
+	// schemaretry is when fetching the schema may next be tried,
+	// after a failure
+	schemaretry time.Time
+	// schemawait is the current delay between schema fetch retries
+	schemawait time.Duration
+	// pdlast is the previous generically decoded perf dump, for
+	// computing rates
+	pdlast perfDump
+	// pdlastt is when pdlast was sampled
+	pdlastt time.Time
+	// pcounters holds the whitelisted counters from the most recent
+	// perf dump
+	pcounters map[string]float64
+	// data is the daemon's data directory, for services where we
+	// look at it directly (MONs)
+	data string
 	// Err holds the error (if any) from the Ping() check
 	Err error
 	// Resp receives response data from Query()
 	Resp []byte
-	// configuration for connections to the admin socket
-	pcconf *petrel.ClientConfig
-        // b0 is where we read the message length into
-        b0 []byte
-        // mlen is the unpacked length from b0
-        mlen int32
-        // mread is the number of bytes read in the message so far
-        mread int32
-        // b1 is the buffer we read into from the network
-        b1 []byte
-        // b2 accumulates data from b1
-        b2 []byte
+	// timeout is the deadline for each admin socket query
+	timeout time.Duration
+	// b0 is where we read the message length into
+	b0 []byte
+	// mlen is the unpacked length from b0
+	mlen int32
+	// mread is the number of bytes read in the message so far
+	mread int32
+	// b1 is the buffer we read into from the network
+	b1 []byte
+	// b2 accumulates data from b1
+	b2 []byte
 }
 
+// Liveness states of a service. A service is up while its updates
+// arrive on time, late when they're overdue, and stale when they've
+// been overdue for long enough that its data can't be trusted. A
+// service which hasn't been heard from at all in a long time is gone.
+const (
+	SvcUp = "up"
+	SvcLate = "late"
+	SvcStale = "stale"
+	SvcGone = "gone"
+)
+
 // SvcCore is the universal core data shared by all service
 // descriptions.
 type SvcCore struct {
@@ -65,45 +106,108 @@ type SvcCore struct {
 
 	// Reporting shows if a service is contactable and responsive
 	Reporting bool `json:"reporting"`
+
+	// State is the service's liveness, as judged by the aggregator
+	// from how recently it has heard from the service. It is one of
+	// the Svc* state constants, and is empty in client updates.
+	State string `json:"state,omitempty"`
 }
 
 // getCephServices examines wlc.CephConf and populates wlc.Svcs
 func (wlc *WLConfig) getCephServices() {
 	wlc.Svcs = make(map[string]*Svc)
-	// iterate over CephConf, adding OSDs and RGWs
-	for k, m := range wlc.CephConf {
-		s := &Svc{Core: &SvcCore{Name: k}}
+	cluster := cephCluster(wlc.CephConfLoc)
+	names := wlc.hostNames()
+	// iterate over CephConf, adding OSDs, MONs, and RGWs
+	for k := range wlc.CephConf {
+		settings := cephDaemonConf(wlc.CephConf, cluster, names[0], k)
+		s := &Svc{Core: &SvcCore{Name: k, Host: settings["host"]}, Sock: settings["admin socket"]}
+		if s.Core.Host == "" {
+			s.Core.Host = names[0]
+		}
 		switch {
 		case strings.HasPrefix(k, "osd."):
 			s.Core.Type = OSD
-			s.Core.Host = m["host"]
-			s.Sock = strings.Replace(wlc.CephConf["osd"]["admin socket"], "$name", k, 1)
 		case strings.HasPrefix(k, "client.radosgw"):
 			s.Core.Type = RGW
-			s.Core.Host = os.Getenv("HOSTNAME")
-			if rsp, ok := m["rgw socket path"]; ok {
+			if rsp := settings["rgw socket path"]; rsp != "" {
 				s.Sock = rsp
-			} else {
-				s.Sock = strings.Replace(m["admin socket"], "$name", k, 1)
 			}
-		case strings.HasPrefix(k, "mon." + os.Getenv("HOSTNAME")):
+		case strings.HasPrefix(k, "mon."):
+			// MONs are only ours if the conf puts them on this
+			// machine. failing that, MONs are conventionally named
+			// after their host.
+			host := settings["host"]
+			if host == "" {
+				host = strings.TrimPrefix(k, "mon.")
+			}
+			if !hostMatch(host, names) {
+				continue
+			}
 			s.Core.Type = MON
-			s.Core.Host = wlc.CephConf[k]["host"]
-			s.Sock = strings.Replace(wlc.CephConf["osd"]["admin socket"], "$name", k, 1)
+			s.data = settings["mon data"]
+		default:
+			continue
 		}
 		// only add defined services to Svcs when the admin
 		// socket exists
-
-		// TODO this shouldn't even be a petrel
-		// client; this is where the custom client for talking
-		// to Ceph goes.
 		if _, err := os.Stat(s.Sock); err == nil {
-			s.pcconf = &petrel.ClientConfig{Addr: s.Sock, Timeout: 100}
+			s.timeout = time.Duration(wlc.Client.Timeout) * time.Millisecond
+			s.counters = wlc.Client.Counters
 			wlc.Svcs[k] = s
 		}
 	}
 }
 
+// hostNames returns the names this machine goes by, for deciding
+// which daemons in the Ceph configuration are ours. The first is the
+// one we report services under: Client.Hostname if it is set, or
+// else the short form of the system hostname. Client.HostAliases
+// come after.
+func (wlc *WLConfig) hostNames() []string {
+	var names []string
+	if wlc.Client.Hostname != "" {
+		names = append(names, wlc.Client.Hostname)
+	} else if sysname, err := os.Hostname(); err == nil && sysname != "" {
+		names = append(names, shortHost(sysname), sysname)
+	}
+	names = append(names, wlc.Client.HostAliases...)
+	if len(names) == 0 {
+		names = append(names, "localhost")
+	}
+	return names
+}
+
+// hostMatch reports whether `host` is one of `names`, ignoring case,
+// and allowing a short name to match the fully-qualified form of
+// itself.
+func hostMatch(host string, names []string) bool {
+	host = strings.ToLower(host)
+	if host == "" {
+		return false
+	}
+	for _, n := range names {
+		n = strings.ToLower(n)
+		switch {
+		case host == n:
+			return true
+		case !strings.Contains(host, ".") && host == shortHost(n):
+			return true
+		case !strings.Contains(n, ".") && shortHost(host) == n:
+			return true
+		}
+	}
+	return false
+}
+
+// shortHost returns the first component of a hostname.
+func shortHost(host string) string {
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
 // Ping sends a version request to a Ceph service. It acts as the test
 // for whether a service is reporting. When successful, it sets
 // Reporting to 'true' and sets the service's Version. When it fails,
@@ -124,6 +228,12 @@ func (s *Svc) Ping() {
 	}
 	s.Core.Reporting = true
 	s.Err = nil
+	// a new version may have a different set of perf counters
+	if vs.Version != s.Core.Version {
+		s.schema = nil
+		s.schemaretry = time.Time{}
+		s.schemawait = 0
+	}
 	s.Core.Version = vs.Version
 }
 
@@ -137,11 +247,20 @@ func (s *Svc) Stat() json.RawMessage {
 		s.Err = err
 		return nil
 	}
+	// pick out any generic counters we've been asked for. this may
+	// need to fetch the perf schema, so hang on to the dump.
+	dump := s.Resp
+	s.pcounters = s.perfCounters(dump)
+	s.Resp = dump
 	var statdata json.RawMessage
-	if s.Core.Type == OSD {
+	switch s.Core.Type {
+	case OSD:
 		statdata = s.StatOsd()
+	case MON:
+		statdata = s.StatMon()
+	case RGW:
+		statdata = s.StatRgw()
 	}
-	// TODO handle MON, RGW
 	return statdata
 }
 
@@ -156,10 +275,42 @@ func (s *Svc) StatOsd() json.RawMessage {
 		return nil
 	}
 	// gather data from it
-	os.BytesUsed = pd.Osd.StatBytes
+	os.BytesUsed = pd.Osd.StatBytesUsed
 	os.BytesAvail = pd.Osd.StatBytesAvail
+	os.BytesTotal = pd.Osd.StatBytes
+	if os.BytesTotal > 0 {
+		os.FillRatio = float64(os.BytesUsed) / float64(os.BytesTotal)
+	}
 	os.PgPrimary = pd.Osd.NumPgPrimary
 	os.PgReplica = pd.Osd.NumPgReplica
+	// latencies are averaged over the interval since the last
+	// sample. on the first sample, that's the daemon's lifetime.
+	now := time.Now()
+	last := s.osdlast
+	if last == nil {
+		last = &cephOsdPerfDumpOsd{}
+	}
+	os.ReadLatency = pd.Osd.OpRLatency.Interval(last.OpRLatency)
+	os.WriteLatency = pd.Osd.OpWLatency.Interval(last.OpWLatency)
+	os.RWLatency = pd.Osd.OpRWLatency.Interval(last.OpRWLatency)
+	// rates need a previous sample
+	if s.osdlast != nil {
+		secs := now.Sub(s.osdlastt).Seconds()
+		os.RateInterval = secs
+		os.OpRate = counterRate(pd.Osd.Op, last.Op, secs)
+		os.ReadOpRate = counterRate(pd.Osd.OpR, last.OpR, secs)
+		os.WriteOpRate = counterRate(pd.Osd.OpW, last.OpW, secs)
+		os.RWOpRate = counterRate(pd.Osd.OpRW, last.OpRW, secs)
+		os.InBytesRate = counterRate(pd.Osd.OpInBytes, last.OpInBytes, secs)
+		os.OutBytesRate = counterRate(pd.Osd.OpOutBytes, last.OpOutBytes, secs)
+		os.SubopRate = counterRate(pd.Osd.Subop, last.Subop, secs)
+		os.RecoveryOpRate = counterRate(pd.Osd.RecoveryOps, last.RecoveryOps, secs)
+		os.PushRate = counterRate(pd.Osd.Push, last.Push, secs)
+		os.PullRate = counterRate(pd.Osd.Pull, last.Pull, secs)
+	}
+	s.osdlast = &pd.Osd
+	s.osdlastt = now
+	os.Counters = s.pcounters
 	// and json-encode our stat struct
 	var raw json.RawMessage
 	raw, err = json.Marshal(os)
@@ -170,25 +321,141 @@ func (s *Svc) StatOsd() json.RawMessage {
 	return raw
 }
 
-// Query sends a request to a Ceph service and reads the result.
-func (s *Svc) Query(req string) error {
-	// make sure we know this command
-	cmd, ok := cephcmds[req]
-	if !ok {
-		return fmt.Errorf("unknown request '%v'\n", req)
+// StatMon is the MON-specific stat update data gathering routine. In
+// addition to 'perf dump' it needs 'mon_status', for quorum info.
+func (s *Svc) StatMon() json.RawMessage {
+	var ms MonStat
+	var pd cephMonPerfDump
+	err := json.Unmarshal(s.Resp, &pd)
+	if err != nil {
+		s.Err = err
+		return nil
+	}
+	ms.Sessions = pd.Mon.NumSessions
+	ms.PaxosCommits = pd.Paxos.Commit
+	ms.PaxosCommitLatency = pd.Paxos.CommitLatency.Avg()
+	ms.Counters = s.pcounters
+	// now get quorum status
+	err = s.Query("mon_status")
+	if err != nil {
+		s.Core.Reporting = false
+		s.Err = err
+		return nil
 	}
+	var mstat cephMonStatus
+	err = json.Unmarshal(s.Resp, &mstat)
+	if err != nil {
+		s.Err = err
+		return nil
+	}
+	ms.Rank = mstat.Rank
+	ms.State = mstat.State
+	ms.ElectionEpoch = mstat.ElectionEpoch
+	// the monmap is how we turn ranks into names. quorum ranks are
+	// sorted, and the leader is always the lowest-ranked MON in
+	// quorum.
+	inquorum := map[int]bool{}
+	for _, rank := range mstat.Quorum {
+		inquorum[rank] = true
+	}
+	ms.Quorum = []string{}
+	ms.OutOfQuorum = []string{}
+	for _, mon := range mstat.Monmap.Mons {
+		if inquorum[mon.Rank] {
+			ms.Quorum = append(ms.Quorum, mon.Name)
+			if len(mstat.Quorum) > 0 && mon.Rank == mstat.Quorum[0] {
+				ms.Leader = mon.Name
+			}
+		} else {
+			ms.OutOfQuorum = append(ms.OutOfQuorum, mon.Name)
+		}
+	}
+	// and the size of the store. failure here isn't fatal; we just
+	// don't know.
+	if s.data != "" {
+		ms.StoreBytes, _ = dirSize(filepath.Join(s.data, "store.db"))
+	}
+	var raw json.RawMessage
+	raw, err = json.Marshal(ms)
+	if err != nil {
+		s.Err = err
+		return nil
+	}
+	return raw
+}
 
-	// make the connection
-	c, err := petrel.UnixClient(s.pcconf)
+// StatRgw is the RGW-specific stat update data gathering routine.
+func (s *Svc) StatRgw() json.RawMessage {
+	var rs RgwStat
+	var pd cephRgwPerfDump
+	err := json.Unmarshal(s.Resp, &pd)
+	if err != nil {
+		s.Err = err
+		return nil
+	}
+	rs.Req = pd.Rgw.Req
+	rs.FailedReq = pd.Rgw.FailedReq
+	rs.Get = pd.Rgw.Get
+	rs.GetBytes = pd.Rgw.GetB
+	rs.GetLatency = pd.Rgw.GetInitialLat.Avg()
+	rs.Put = pd.Rgw.Put
+	rs.PutBytes = pd.Rgw.PutB
+	rs.PutLatency = pd.Rgw.PutInitialLat.Avg()
+	rs.Qlen = pd.Rgw.Qlen
+	rs.Qactive = pd.Rgw.Qactive
+	rs.CacheHit = pd.Rgw.CacheHit
+	rs.CacheMiss = pd.Rgw.CacheMiss
+	rs.Counters = s.pcounters
+	var raw json.RawMessage
+	raw, err = json.Marshal(rs)
 	if err != nil {
-		return fmt.Errorf("could not connect to sock %s: %s\n", s.Sock, err)
+		s.Err = err
+		return nil
+	}
+	return raw
+}
+
+// counterRate returns the per-second rate of change of a monotonic
+// counter over `secs` seconds. If the counter has gone backwards, the
+// daemon has restarted and the counter began again from zero, so the
+// current value is all the change we can account for.
+func counterRate(cur, prev int, secs float64) float64 {
+	if secs <= 0 {
+		return 0
+	}
+	if cur < prev {
+		prev = 0
 	}
-	defer c.Quit()
+	return float64(cur-prev) / secs
+}
+
+// dirSize returns the total size of the regular files under `dir`.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Query sends an argumentless request, such as "version" or "perf
+// dump", to a Ceph service and reads the result into s.Resp.
+func (s *Svc) Query(req string) error {
+	return s.QueryCmd(NewCephCmd(req))
+}
 
-	// dispatch and return
-	s.Resp, err = c.Dispatch(cmd)
+// QueryCmd sends an arbitrary command to a Ceph service and reads the
+// result into s.Resp.
+func (s *Svc) QueryCmd(cmd *CephCmd) error {
+	b, err := cmd.Bytes()
 	if err != nil {
-		return fmt.Errorf("could not read reply on %s: %s\n", s.Sock, err)
+		return fmt.Errorf("bad request '%v': %s", cmd.Prefix, err)
 	}
-	return err
+	return s.asockDispatch(b)
 }
@@ -1,8 +1,14 @@
 package whiplash
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetOSDSvcs(t *testing.T) {
@@ -45,7 +51,6 @@ func TestGetOSDSvcs(t *testing.T) {
 }
 
 func TestGetMONSvcs(t *testing.T) {
-	os.Setenv("HOSTNAME", "peon9999")
 	// read the MON config file
 	c, err := New("./test_corpus/test.config", true)
 	if err != nil {
@@ -85,7 +90,6 @@ func TestGetMONSvcs(t *testing.T) {
 }
 
 func TestGetRGWSvcs(t *testing.T) {
-	os.Setenv("HOSTNAME", "peon9999")
 	// read the RGW config file
 	c, err := New("./test_corpus/testrgw.config", true)
 	if err != nil {
@@ -123,3 +127,356 @@ func TestGetRGWSvcs(t *testing.T) {
 		}
 	}
 }
+
+func TestStatMon(t *testing.T) {
+	pd, err := ioutil.ReadFile("./test_corpus/perfdumps/mon.perfdump.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := ioutil.ReadFile("./test_corpus/perfdumps/mon.status.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{"perf dump": pd, "mon_status": ms})
+	defer fa.close()
+	// fake up a mon store
+	data, err := ioutil.TempDir("", "whiplash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	os.Mkdir(data+"/store.db", 0755)
+	ioutil.WriteFile(data+"/store.db/000001.sst", make([]byte, 1000), 0644)
+	ioutil.WriteFile(data+"/store.db/000002.sst", make([]byte, 24), 0644)
+
+	s := &Svc{Core: &SvcCore{Name: "mon.peon9999", Type: MON}, Sock: fa.sock, data: data, timeout: 250 * time.Millisecond}
+	raw := s.Stat()
+	if s.Err != nil {
+		t.Fatalf("Stat on MON failed: %v", s.Err)
+	}
+	var stat MonStat
+	err = json.Unmarshal(raw, &stat)
+	if err != nil {
+		t.Fatalf("couldn't unmarshal MonStat: %v", err)
+	}
+	if stat.Rank != 4 || stat.State != "peon" || stat.ElectionEpoch != 1234 {
+		t.Errorf("bad rank/state/epoch: %v/%v/%v", stat.Rank, stat.State, stat.ElectionEpoch)
+	}
+	if stat.Leader != "peon9995" {
+		t.Errorf("leader should be peon9995 but is %v", stat.Leader)
+	}
+	if strings.Join(stat.Quorum, ",") != "peon9995,peon9996,peon9997,peon9999" {
+		t.Errorf("bad quorum: %v", stat.Quorum)
+	}
+	if strings.Join(stat.OutOfQuorum, ",") != "peon9998" {
+		t.Errorf("bad out of quorum list: %v", stat.OutOfQuorum)
+	}
+	if stat.Sessions != 42 || stat.PaxosCommits != 800 {
+		t.Errorf("bad sessions/commits: %v/%v", stat.Sessions, stat.PaxosCommits)
+	}
+	if stat.PaxosCommitLatency != 0.005 {
+		t.Errorf("paxos commit latency should be 0.005 but is %v", stat.PaxosCommitLatency)
+	}
+	if stat.StoreBytes != 1024 {
+		t.Errorf("store size should be 1024 but is %v", stat.StoreBytes)
+	}
+}
+
+func TestStatRgw(t *testing.T) {
+	pd, err := ioutil.ReadFile("./test_corpus/perfdumps/rgw.perfdump.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{"perf dump": pd})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "client.radosgw.peon9999", Type: RGW}, Sock: fa.sock, timeout: 250 * time.Millisecond}
+	raw := s.Stat()
+	if s.Err != nil {
+		t.Fatalf("Stat on RGW failed: %v", s.Err)
+	}
+	var stat RgwStat
+	err = json.Unmarshal(raw, &stat)
+	if err != nil {
+		t.Fatalf("couldn't unmarshal RgwStat: %v", err)
+	}
+	expected := RgwStat{Req: 10000, FailedReq: 25, Get: 6000, GetBytes: 600000000, GetLatency: 0.005,
+		Put: 3000, PutBytes: 300000000, PutLatency: 0.02, Qlen: 3, Qactive: 7, CacheHit: 9000, CacheMiss: 1000}
+	if !reflect.DeepEqual(stat, expected) {
+		t.Errorf("expected %+v but got %+v", expected, stat)
+	}
+}
+
+func TestStatOsd(t *testing.T) {
+	tests := []struct {
+		pdfile string
+		stat OsdStat
+	}{
+		{"./test_corpus/perfdumps/osd.perfdump.json", OsdStat{BytesUsed: 1198736670720,
+			BytesAvail: 2760108466054, BytesTotal: 3998833471488,
+			FillRatio: 1198736670720.0 / 3998833471488.0, ReadLatency: 0.004, WriteLatency: 0.02,
+			RWLatency: 0.03, PgPrimary: 104, PgReplica: 208}},
+		// no ops have happened, so latencies are 0
+		{"./test_corpus/perfdumps/osd.empty.perfdump.json", OsdStat{BytesUsed: 35651584,
+			BytesAvail: 1978661184267, BytesTotal: 1998683672576,
+			FillRatio: 35651584.0 / 1998683672576.0, PgPrimary: 104, PgReplica: 208}},
+		// bluestore OSDs have a very different perf dump, but the
+		// osd section is the same
+		{"./test_corpus/perfdumps/osd.bluestore.perfdump.json", OsdStat{BytesUsed: 1500000000000,
+			BytesAvail: 2498833471488, BytesTotal: 3998833471488,
+			FillRatio: 1500000000000.0 / 3998833471488.0, ReadLatency: 0.004, WriteLatency: 0.02,
+			RWLatency: 0.03, PgPrimary: 50, PgReplica: 100}},
+	}
+	fa := newFakeAsock(t, "./test_corpus/fake.asok", map[string][]byte{})
+	defer fa.close()
+	s := &Svc{Core: &SvcCore{Name: "osd.9900", Type: OSD}, Sock: fa.sock, timeout: 250 * time.Millisecond}
+	for _, test := range tests {
+		// each fixture is a first sample, with no rates
+		s.osdlast = nil
+		pd, err := ioutil.ReadFile(test.pdfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fa.resps["perf dump"] = pd
+		raw := s.Stat()
+		if s.Err != nil {
+			t.Fatalf("%v: Stat on OSD failed: %v", test.pdfile, s.Err)
+		}
+		var stat OsdStat
+		err = json.Unmarshal(raw, &stat)
+		if err != nil {
+			t.Fatalf("%v: couldn't unmarshal OsdStat: %v", test.pdfile, err)
+		}
+		if !reflect.DeepEqual(stat, test.stat) {
+			t.Errorf("%v: expected %+v but got %+v", test.pdfile, test.stat, stat)
+		}
+	}
+	// now for rates. pretend the last sample was 10s ago, and that
+	// there have been some ops since then.
+	pd, _ := ioutil.ReadFile("./test_corpus/perfdumps/osd.perfdump.json")
+	fa.resps["perf dump"] = pd
+	s.Stat()
+	s.osdlastt = time.Now().Add(-10 * time.Second)
+	s.osdlast.Op -= 1000
+	s.osdlast.OpInBytes -= 40960000
+	s.osdlast.RecoveryOps -= 50
+	raw := s.Stat()
+	var stat OsdStat
+	json.Unmarshal(raw, &stat)
+	if stat.RateInterval < 10 || stat.RateInterval > 10.5 {
+		t.Errorf("rate interval should be about 10s but is %v", stat.RateInterval)
+	}
+	if stat.OpRate < 95 || stat.OpRate > 100 {
+		t.Errorf("op rate should be about 100 but is %v", stat.OpRate)
+	}
+	if stat.InBytesRate < 3900000 || stat.InBytesRate > 4096000 {
+		t.Errorf("in bytes rate should be about 4096000 but is %v", stat.InBytesRate)
+	}
+	if stat.RecoveryOpRate < 4.75 || stat.RecoveryOpRate > 5 {
+		t.Errorf("recovery op rate should be about 5 but is %v", stat.RecoveryOpRate)
+	}
+	if stat.ReadOpRate != 0 || stat.PushRate != 0 {
+		t.Errorf("unchanged counters should have 0 rate; got %v, %v", stat.ReadOpRate, stat.PushRate)
+	}
+
+	// weights come from CRUSH
+	cm, err := CrushLoad("./test_corpus/osdtree.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat = OsdStat{}
+	stat.SetCrush(cm.OsdNames["osd.9901"])
+	if stat.Weight != 2 || stat.Reweight != 0.85 {
+		t.Errorf("expected weight 2 and reweight 0.85 but got %v, %v", stat.Weight, stat.Reweight)
+	}
+}
+
+func TestPerfAvgInterval(t *testing.T) {
+	tests := []struct {
+		cur, prev cephPerfAvg
+		avg, intv float64
+	}{
+		// first sample
+		{cephPerfAvg{100, 2.0}, cephPerfAvg{}, 0.02, 0.02},
+		// normal interval
+		{cephPerfAvg{300, 3.0}, cephPerfAvg{100, 2.0}, 0.01, 0.005},
+		// nothing happened
+		{cephPerfAvg{300, 3.0}, cephPerfAvg{300, 3.0}, 0.01, 0},
+		// counter reset
+		{cephPerfAvg{10, 0.5}, cephPerfAvg{300, 3.0}, 0.05, 0.05},
+		// never anything
+		{cephPerfAvg{}, cephPerfAvg{}, 0, 0},
+	}
+	for i, test := range tests {
+		if test.cur.Avg() != test.avg {
+			t.Errorf("%d: Avg should be %v but is %v", i, test.avg, test.cur.Avg())
+		}
+		if test.cur.Interval(test.prev) != test.intv {
+			t.Errorf("%d: Interval should be %v but is %v", i, test.intv, test.cur.Interval(test.prev))
+		}
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	tests := []struct {
+		cur, prev int
+		secs, rate float64
+	}{
+		{1000, 500, 10, 50},
+		{500, 500, 10, 0},
+		// reset
+		{200, 500, 10, 20},
+		// no time has passed
+		{1000, 500, 0, 0},
+	}
+	for _, test := range tests {
+		rate := counterRate(test.cur, test.prev, test.secs)
+		if rate != test.rate {
+			t.Errorf("%v -> %v over %vs should be %v/s but is %v", test.prev, test.cur, test.secs, test.rate, rate)
+		}
+	}
+}
+
+func TestHostMatch(t *testing.T) {
+	names := []string{"store1", "store1.example.com", "Alias"}
+	tests := []struct {
+		host string
+		match bool
+	}{
+		{"store1", true},
+		{"STORE1", true},
+		{"store1.example.com", true},
+		// a short name in the conf matches our FQDN, and vice versa
+		{"store1.other.com", true},
+		{"alias", true},
+		{"alias.example.com", true},
+		{"store11", false},
+		{"store", false},
+		{"store2.example.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := hostMatch(test.host, names); got != test.match {
+			t.Errorf("%q: expected %v but got %v", test.host, test.match, got)
+		}
+	}
+	// an FQDN doesn't match a different FQDN for the same short name
+	if hostMatch("store1.example.com", []string{"store1.other.com"}) {
+		t.Errorf("store1.example.com shouldn't match store1.other.com")
+	}
+}
+
+func TestHostNames(t *testing.T) {
+	wlc := &WLConfig{}
+	sysname, err := os.Hostname()
+	if err != nil {
+		t.Skip("no system hostname")
+	}
+	names := wlc.hostNames()
+	if names[0] != shortHost(sysname) || !hostMatch(sysname, names) {
+		t.Errorf("names for %q should start with its short form; got %v", sysname, names)
+	}
+	// the configured hostname replaces the system's, and aliases
+	// are added
+	wlc.Client.Hostname = "store1"
+	wlc.Client.HostAliases = []string{"store1-backend"}
+	names = wlc.hostNames()
+	if !reflect.DeepEqual(names, []string{"store1", "store1-backend"}) {
+		t.Errorf("expected configured names but got %v", names)
+	}
+}
+
+func TestGetCephServicesHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wlsvcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := `[global]
+admin socket = DIR/$cluster-$name.asok
+[osd]
+# this must not leak into MONs or RGWs
+admin socket = DIR/osd-$name.asok
+[mon]
+mon data = /srv/$cluster/$name
+[mon.a]
+host = store1.example.com
+[mon.b]
+host = store2
+[mon.store1]
+[osd.1]
+host = store1
+[osd.2]
+[client]
+rgw socket path = DIR/rgw-$id.sock
+[client.radosgw.gw1]
+host = gw-frontend
+[client.radosgw.gw2]
+rgw socket path =
+`
+	conf = strings.Replace(conf, "DIR", dir, -1)
+	cephconf := filepath.Join(dir, "prod.conf")
+	if err := ioutil.WriteFile(cephconf, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, sock := range []string{"prod-mon.a.asok", "prod-mon.b.asok", "prod-mon.store1.asok",
+		"osd-mon.a.asok", "osd-osd.1.asok", "osd-osd.2.asok", "rgw-radosgw.gw1.sock",
+		"prod-client.radosgw.gw2.asok"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, sock), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wlc := &WLConfig{CephConfLoc: cephconf, Client: WLCliConfig{Hostname: "store1"}}
+	wlc.CephConf, err = parseCephConf(cephconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wlc.getCephServices()
+	want := map[string]struct {
+		typ int
+		host, sock string
+	}{
+		"mon.a": {MON, "store1.example.com", "prod-mon.a.asok"},
+		"mon.store1": {MON, "store1", "prod-mon.store1.asok"},
+		"osd.1": {OSD, "store1", "osd-osd.1.asok"},
+		"osd.2": {OSD, "store1", "osd-osd.2.asok"},
+		"client.radosgw.gw1": {RGW, "gw-frontend", "rgw-radosgw.gw1.sock"},
+		// an empty rgw socket path doesn't exist, so this falls back
+		// to the admin socket. That comes from [global], not [osd].
+		"client.radosgw.gw2": {RGW, "store1", "prod-client.radosgw.gw2.asok"},
+	}
+	if len(wlc.Svcs) != len(want) {
+		t.Errorf("expected %d services but got %d: %v", len(want), len(wlc.Svcs), wlc.Svcs)
+	}
+	for name, w := range want {
+		svc, ok := wlc.Svcs[name]
+		if !ok {
+			t.Errorf("should have found %s but did not", name)
+			continue
+		}
+		if svc.Core.Type != w.typ || svc.Core.Host != w.host || svc.Sock != filepath.Join(dir, w.sock) {
+			t.Errorf("%s: expected %d %s %s but got %d %s %s", name, w.typ, w.host, w.sock,
+				svc.Core.Type, svc.Core.Host, svc.Sock)
+		}
+	}
+	if d := wlc.Svcs["mon.a"].data; d != "/srv/prod/mon.a" {
+		t.Errorf("mon.a should have data /srv/prod/mon.a but has %q", d)
+	}
+	// an alias makes mon.b ours too
+	wlc.Client.HostAliases = []string{"store2.example.com"}
+	wlc.getCephServices()
+	if svc, ok := wlc.Svcs["mon.b"]; !ok || svc.Core.Host != "store2" {
+		t.Errorf("mon.b should have been found via alias; got %v", wlc.Svcs)
+	}
+	// and the FQDN finds the same MONs as the short name
+	wlc.Client.Hostname = "STORE1.example.com"
+	wlc.Client.HostAliases = nil
+	wlc.getCephServices()
+	for _, name := range []string{"mon.a", "mon.store1"} {
+		if _, ok := wlc.Svcs[name]; !ok {
+			t.Errorf("%s should have been found by FQDN", name)
+		}
+	}
+	if _, ok := wlc.Svcs["mon.b"]; ok {
+		t.Errorf("mon.b shouldn't have been found")
+	}
+}
@@ -31,41 +31,45 @@ package whiplash
 // instead of holding actual node objects, or even the names of their
 // child nodes, hold the ID numbers of their child nodes.
 //
-// To work around this, the top-level structure (osdtree) is defined
-// as containing two slices of json.RawMessage. Then, when iterating
-// over osdtree.Nodes, we take the most brute force approach possible:
-// try to Unmarshal the RawMessage into an osdtreeContainer; if that
-// produces an error, Unmarshal it into an osdtreeOSD.
+// To work around this, every entry in "nodes" and "stray" is
+// unmarshaled into an osdtreeNode, which has the union of the fields
+// of both kinds of node. Type "osd" nodes become CrushOsds and
+// everything else becomes a CrushBucket. Once everything has been
+// read, a second pass resolves the "children" ID lists into actual
+// links, in both directions.
+//
+// Nothing here assumes any particular set of bucket types. Rows,
+// racks, and hosts are common, but datacenters, rooms, chassis, or
+// anything else someone has put in their CRUSH map work just as well.
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
 )
 
-// These three types 
+// osdtree is the top-level structure of 'ceph osd tree' output.
 type osdtree struct {
-	Nodes []json.RawMessage `json:"nodes"`
-	Stray []json.RawMessage `json:"stray"`
-}
-type osdtreeContainer struct {
-	ID int         `json:"id"`
-	Name string    `json:"name"`
-	Type string    `json:"type"`
-	Type_ID int    `json:"type_id"`
-	Children []int `json:"children"`
+	Nodes []osdtreeNode `json:"nodes"`
+	Stray []osdtreeNode `json:"stray"`
 }
-type osdtreeOSD struct {
-	ID int           `json:"id"`
-	Name string      `json:"name"`
-	Type string     `json:"type"`
-	Type_id int      `json:"type_id"`
-	Weight float64   `json:"crush_weight"`
-	Depth int        `json:"depth"`
-	Exists int       `json:"exists"`
-	Status string    `json:"status"`
-	Reweight float64 `json:"reweight"`
-	Affinity float64 `json:"primary_affinity"`
+
+// osdtreeNode is a single node from 'ceph osd tree'. Buckets only use
+// the first five fields; OSDs use everything but Children.
+type osdtreeNode struct {
+	ID int            `json:"id"`
+	Name string       `json:"name"`
+	Type string       `json:"type"`
+	Type_ID int       `json:"type_id"`
+	Children []int    `json:"children"`
+	Weight float64    `json:"crush_weight"`
+	Depth int         `json:"depth"`
+	Exists int        `json:"exists"`
+	Status string     `json:"status"`
+	Reweight float64  `json:"reweight"`
+	Affinity float64  `json:"primary_affinity"`
 }
 
 // osdtreeDump calls 'ceph osd tree -f json' and writes the output to
@@ -82,28 +86,158 @@ func osdtreeDump(output string) error {
 	return err
 }
 
-// osdtreeParse reads a JSON dump of 'ceph osd tree' and
-// populates/updates datastructures with it.
-func osdtreeParse(input string) error {
+// CrushLoad builds a CrushMap from the output of 'ceph osd tree'. If
+// `input` is empty, ceph is run to get the tree; otherwise `input` is
+// read as a file containing a previously-dumped tree.
+func CrushLoad(input string) (*CrushMap, error) {
+	if input != "" {
+		return osdtreeParse(input)
+	}
+	f, err := ioutil.TempFile("", "whiplash-osdtree")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	err = osdtreeDump(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't dump osd tree: %s", err)
+	}
+	return osdtreeParse(f.Name())
+}
+
+// osdtreeParse reads a JSON dump of 'ceph osd tree' and builds a
+// CrushMap from it.
+func osdtreeParse(input string) (*CrushMap, error) {
 	jtree, err := ioutil.ReadFile(input)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var tree osdtree
 	err = json.Unmarshal(jtree, &tree)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	cm := &CrushMap{
+		Buckets: make(map[int]*CrushBucket),
+		BucketNames: make(map[string]*CrushBucket),
+		Osds: make(map[int]*CrushOsd),
+		OsdNames: make(map[string]*CrushOsd),
 	}
-	var jcont osdtreeContainer
-	var josd osdtreeOSD
+	// first pass: create everything
 	for _, node := range tree.Nodes {
-		err = json.Unmarshal(node, &josd)
-		if err == nil {
-			//fmt.Printf("Node %d: type %s, name %s\n", i, josd.Type, josd.Name)
-		} else {
-			json.Unmarshal(node, &jcont)
-			//fmt.Printf("Node %d: type %s, name %s\n", i, jcont.Type, jcont.Name)
+		if node.Type == "osd" {
+			if _, err := cm.addOsd(node); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, ok := cm.Buckets[node.ID]; ok {
+			return nil, fmt.Errorf("duplicate bucket id %d", node.ID)
 		}
+		b := &CrushBucket{ID: node.ID, Name: node.Name, Type: node.Type, TypeID: node.Type_ID}
+		cm.Buckets[b.ID] = b
+		cm.BucketNames[b.Name] = b
 	}
-	return err
+	for _, node := range tree.Stray {
+		o, err := cm.addOsd(node)
+		if err != nil {
+			return nil, err
+		}
+		cm.Stray = append(cm.Stray, o)
+	}
+	// second pass: link children and parents. 'ceph osd crush link'
+	// can put a bucket or OSD in more than one bucket; each of them
+	// holds it as a child, but only the first is its Parent.
+	for _, node := range tree.Nodes {
+		if node.Type == "osd" {
+			continue
+		}
+		b := cm.Buckets[node.ID]
+		for _, cid := range node.Children {
+			if cb, ok := cm.Buckets[cid]; ok {
+				if cb.Parent == nil {
+					cb.Parent = b
+				}
+				b.Buckets = append(b.Buckets, cb)
+			} else if co, ok := cm.Osds[cid]; ok {
+				if co.Parent == nil {
+					co.Parent = b
+				}
+				b.Osds = append(b.Osds, co)
+			} else {
+				return nil, fmt.Errorf("bucket %s has unknown child %d", b.Name, cid)
+			}
+		}
+	}
+	// anything without a parent is a root. walk nodes again rather
+	// than the map, to preserve ordering.
+	for _, node := range tree.Nodes {
+		if b, ok := cm.Buckets[node.ID]; ok && b.Parent == nil && node.Type != "osd" {
+			cm.Roots = append(cm.Roots, b)
+		}
+	}
+	return cm, nil
+}
+
+// addOsd creates a CrushOsd from an osdtreeNode and adds it to the
+// map's indices.
+func (cm *CrushMap) addOsd(node osdtreeNode) (*CrushOsd, error) {
+	if _, ok := cm.Osds[node.ID]; ok {
+		return nil, fmt.Errorf("duplicate osd id %d", node.ID)
+	}
+	o := &CrushOsd{
+		ID: node.ID,
+		Name: node.Name,
+		Weight: node.Weight,
+		Reweight: node.Reweight,
+		Affinity: node.Affinity,
+		Up: node.Status == "up",
+		Exists: node.Exists == 1,
+	}
+	cm.Osds[o.ID] = o
+	cm.OsdNames[o.Name] = o
+	return o, nil
+}
+
+// Changes compares cm to an older CrushMap and returns the number of
+// buckets and OSDs which were added, removed, moved, or altered. If
+// `old` is nil, everything in cm counts as changed.
+func (cm *CrushMap) Changes(old *CrushMap) (buckets, osds int) {
+	if old == nil {
+		return len(cm.Buckets), len(cm.Osds)
+	}
+	for id, b := range cm.Buckets {
+		ob, ok := old.Buckets[id]
+		if !ok || ob.Name != b.Name || ob.Type != b.Type || bucketID(ob.Parent) != bucketID(b.Parent) {
+			buckets++
+		}
+	}
+	for id := range old.Buckets {
+		if _, ok := cm.Buckets[id]; !ok {
+			buckets++
+		}
+	}
+	for id, o := range cm.Osds {
+		oo, ok := old.Osds[id]
+		if !ok || bucketID(oo.Parent) != bucketID(o.Parent) || oo.Weight != o.Weight ||
+			oo.Reweight != o.Reweight || oo.Affinity != o.Affinity || oo.Up != o.Up || oo.Exists != o.Exists {
+			osds++
+		}
+	}
+	for id := range old.Osds {
+		if _, ok := cm.Osds[id]; !ok {
+			osds++
+		}
+	}
+	return buckets, osds
+}
+
+// bucketID returns the ID of a bucket, or 0 (which is never a bucket
+// ID) for nil.
+func bucketID(b *CrushBucket) int {
+	if b == nil {
+		return 0
+	}
+	return b.ID
 }
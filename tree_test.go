@@ -0,0 +1,189 @@
+package whiplash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOsdtreeParse(t *testing.T) {
+	// bad file first
+	_, err := osdtreeParse("./test_corpus/zzzxxx")
+	if err == nil {
+		t.Errorf("parsing nonexistent file should have failed")
+	}
+	_, err = osdtreeParse("./test_corpus/notjson.config")
+	if err == nil {
+		t.Errorf("parsing non-json file should have failed")
+	}
+	cm, err := osdtreeParse("./test_corpus/osdtree.json")
+	if err != nil {
+		t.Fatalf("parsing osdtree.json failed: %v", err)
+	}
+	if len(cm.Roots) != 1 || cm.Roots[0].Name != "default" {
+		t.Errorf("expected one root named default, got %v", cm.Roots)
+	}
+	if len(cm.Buckets) != 9 || len(cm.BucketNames) != 9 {
+		t.Errorf("expected 9 buckets, got %v/%v", len(cm.Buckets), len(cm.BucketNames))
+	}
+	if len(cm.Osds) != 5 || len(cm.OsdNames) != 5 {
+		t.Errorf("expected 5 osds, got %v/%v", len(cm.Osds), len(cm.OsdNames))
+	}
+	// buckets are linked both ways
+	rack := cm.BucketNames["irv-n1"]
+	if rack == nil || rack.ID != -5 || rack.Type != "rack" {
+		t.Fatalf("rack irv-n1 not as expected: %v", rack)
+	}
+	if rack.Parent != cm.Buckets[-3] || rack.Parent.Name != "irv-n" {
+		t.Errorf("irv-n1 should have parent irv-n but has %v", rack.Parent)
+	}
+	if len(rack.Buckets) != 1 || rack.Buckets[0].Name != "cephstore9999" {
+		t.Errorf("irv-n1 should contain cephstore9999 but has %v", rack.Buckets)
+	}
+	if len(cm.BucketNames["irv-s"].Buckets) != 0 {
+		t.Errorf("irv-s should be empty")
+	}
+	// osds have their attributes and locations
+	osd := cm.OsdNames["osd.9901"]
+	if osd == nil || osd.ID != 9901 {
+		t.Fatalf("osd.9901 not as expected: %v", osd)
+	}
+	if osd.Weight != 2 || osd.Reweight != 0.85 || osd.Affinity != 1 || !osd.Up || !osd.Exists {
+		t.Errorf("osd.9901 attributes not as expected: %+v", osd)
+	}
+	if cm.Osds[9902].Up || cm.Osds[9902].Affinity != 0.5 {
+		t.Errorf("osd.9902 attributes not as expected: %+v", cm.Osds[9902])
+	}
+	if osd.Parent.Name != "cephstore9999" || osd.Ancestor("rack").Name != "irv-n1" ||
+		osd.Ancestor("row").Name != "irv-n" || osd.Ancestor("datacenter").Name != "irv" {
+		t.Errorf("osd.9901 location not as expected: %v", osd.Location())
+	}
+	if osd.Ancestor("chassis") != nil {
+		t.Errorf("osd.9901 should have no chassis")
+	}
+	loc := cm.OsdNames["osd.9903"].Location()
+	if loc["chassis"] != "chassis-a" || loc["host"] != "cephstore9998" || loc["rack"] != "irv-n2" || loc["root"] != "default" {
+		t.Errorf("osd.9903 location not as expected: %v", loc)
+	}
+	if len(cm.BucketNames["irv"].AllOsds()) != 4 {
+		t.Errorf("datacenter irv should hold 4 osds but holds %v", len(cm.BucketNames["irv"].AllOsds()))
+	}
+	// strays are indexed, but have no parent
+	if len(cm.Stray) != 1 || cm.Stray[0].Name != "osd.9904" || cm.Stray[0].Parent != nil {
+		t.Errorf("expected stray osd.9904 but got %v", cm.Stray)
+	}
+	if cm.OsdNames["osd.9904"] != cm.Stray[0] || len(cm.OsdNames["osd.9904"].Location()) != 0 {
+		t.Errorf("stray osd.9904 not indexed correctly")
+	}
+}
+
+func TestOsdtreeParseBad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wltree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := `{"id": -2, "name": "h1", "type": "host", "children": [1]}`
+	osd1 := `{"id": 1, "name": "osd.1", "type": "osd"}`
+	tests := map[string]string{
+		"duplicate bucket": `{"nodes": [` + host + `, {"id": -2, "name": "h2", "type": "host"}, ` + osd1 + `]}`,
+		"duplicate osd": `{"nodes": [` + host + `, ` + osd1 + `, {"id": 1, "name": "osd.1a", "type": "osd"}]}`,
+		"stray duplicates osd": `{"nodes": [` + host + `, ` + osd1 + `], "stray": [` + osd1 + `]}`,
+		"unknown child": `{"nodes": [{"id": -2, "name": "h1", "type": "host", "children": [7]}]}`,
+	}
+	for name, tree := range tests {
+		file := filepath.Join(dir, "tree.json")
+		if err := ioutil.WriteFile(file, []byte(tree), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := osdtreeParse(file); err == nil {
+			t.Errorf("%s should have failed to parse", name)
+		}
+	}
+	// and the same tree without the problem is fine
+	file := filepath.Join(dir, "tree.json")
+	ioutil.WriteFile(file, []byte(`{"nodes": [`+host+`, `+osd1+`]}`), 0644)
+	if cm, err := osdtreeParse(file); err != nil || cm.OsdNames["osd.1"].Parent.Name != "h1" {
+		t.Errorf("good tree failed to parse: %v", err)
+	}
+}
+
+func TestOsdtreeParseLinked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wltree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// h1 is linked into both racks, and osd.1 into both hosts
+	tree := `{"nodes": [
+		{"id": -1, "name": "default", "type": "root", "children": [-2, -3]},
+		{"id": -2, "name": "r1", "type": "rack", "children": [-4, -5]},
+		{"id": -3, "name": "r2", "type": "rack", "children": [-4]},
+		{"id": -4, "name": "h1", "type": "host", "children": [1, 2]},
+		{"id": -5, "name": "h2", "type": "host", "children": [1]},
+		{"id": 1, "name": "osd.1", "type": "osd"},
+		{"id": 2, "name": "osd.2", "type": "osd"}]}`
+	file := filepath.Join(dir, "tree.json")
+	if err := ioutil.WriteFile(file, []byte(tree), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := osdtreeParse(file)
+	if err != nil {
+		t.Fatalf("linked tree failed to parse: %v", err)
+	}
+	if len(cm.Roots) != 1 || cm.Roots[0].Name != "default" {
+		t.Errorf("expected one root named default, got %v", cm.Roots)
+	}
+	// the first bucket to claim something is its parent...
+	h1, o1 := cm.BucketNames["h1"], cm.OsdNames["osd.1"]
+	if h1.Parent.Name != "r1" || o1.Parent.Name != "h1" {
+		t.Errorf("h1 and osd.1 should have parents r1 and h1 but have %v and %v", h1.Parent.Name, o1.Parent.Name)
+	}
+	// ...but every bucket holds it
+	if r2 := cm.BucketNames["r2"]; len(r2.Buckets) != 1 || r2.Buckets[0] != h1 {
+		t.Errorf("r2 should hold h1 but holds %v", r2.Buckets)
+	}
+	if h2 := cm.BucketNames["h2"]; len(h2.Osds) != 1 || h2.Osds[0] != o1 {
+		t.Errorf("h2 should hold osd.1 but holds %v", h2.Osds)
+	}
+	if n := len(cm.BucketNames["r2"].AllOsds()); n != 2 {
+		t.Errorf("r2 should hold 2 osds but holds %v", n)
+	}
+	// and nothing is counted twice
+	if n := len(cm.Roots[0].AllOsds()); n != 2 {
+		t.Errorf("default should hold 2 osds but holds %v", n)
+	}
+	if n := len(cm.Roots[0].Descendants("host")); n != 2 {
+		t.Errorf("default should hold 2 hosts but holds %v", n)
+	}
+}
+
+func TestCrushChanges(t *testing.T) {
+	cm, err := CrushLoad("./test_corpus/osdtree.json")
+	if err != nil {
+		t.Fatalf("loading osdtree.json failed: %v", err)
+	}
+	b, o := cm.Changes(nil)
+	if b != 9 || o != 5 {
+		t.Errorf("everything should be changed vs nil; got %v buckets, %v osds", b, o)
+	}
+	old, _ := CrushLoad("./test_corpus/osdtree.json")
+	b, o = cm.Changes(old)
+	if b != 0 || o != 0 {
+		t.Errorf("nothing should be changed; got %v buckets, %v osds", b, o)
+	}
+	// reweight an OSD, move a host, and drop a bucket
+	cm.OsdNames["osd.9900"].Reweight = 0.5
+	cm.BucketNames["cephstore9998"].Parent = cm.BucketNames["irv-n1"]
+	delete(cm.Buckets, cm.BucketNames["irv-s"].ID)
+	b, o = cm.Changes(old)
+	if b != 2 || o != 1 {
+		t.Errorf("expected 2 buckets and 1 osd changed; got %v buckets, %v osds", b, o)
+	}
+	// descendants
+	hosts := old.BucketNames["irv-n"].Descendants("host")
+	if len(hosts) != 2 || hosts[0].Name != "cephstore9998" || hosts[1].Name != "cephstore9999" {
+		t.Errorf("irv-n should have 2 hosts but has %v", hosts)
+	}
+}
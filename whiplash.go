@@ -9,32 +9,135 @@ const (
 	Version = "0.5.0"
 )
 
-// Row represents a datacenter row. It contains Racks.
-type Row struct {
-	Id int
+// CrushMap is the CRUSH hierarchy of a cluster, as reported by 'ceph
+// osd tree'.
+type CrushMap struct {
+	// Roots is the top-level buckets of the hierarchy
+	Roots []*CrushBucket
+	// Buckets holds every bucket, keyed by CRUSH ID
+	Buckets map[int]*CrushBucket
+	// BucketNames holds every bucket, keyed by name
+	BucketNames map[string]*CrushBucket
+	// Osds holds every OSD, including strays, keyed by ID
+	Osds map[int]*CrushOsd
+	// OsdNames holds every OSD, including strays, keyed by name
+	OsdNames map[string]*CrushOsd
+	// Stray is the OSDs which exist but are not in the hierarchy
+	Stray []*CrushOsd
+}
+
+// CrushBucket is an interior node of the CRUSH hierarchy: a row,
+// rack, host, or any other bucket type. Buckets have negative IDs.
+type CrushBucket struct {
+	ID int
+	Name string
+	// Type is the bucket type name, e.g. "rack"
+	Type string
+	TypeID int
+	// Parent is the containing bucket. It is nil for roots. A bucket
+	// which is linked into several buckets has the first as Parent.
+	Parent *CrushBucket `json:"-"`
+	// Buckets is the child buckets of this bucket
+	Buckets []*CrushBucket
+	// Osds is the OSDs directly under this bucket
+	Osds []*CrushOsd
+}
+
+// CrushOsd is a leaf of the CRUSH hierarchy.
+type CrushOsd struct {
+	ID int
 	Name string
-	Children map[string]*Rack
+	// Parent is the bucket the OSD lives in. It is nil for strays. An
+	// OSD which is linked into several buckets has the first as Parent.
+	Parent *CrushBucket `json:"-"`
+	// Weight is the crush weight of the OSD
+	Weight float64
+	// Reweight is the override weight of the OSD, from 0 to 1
+	Reweight float64
+	// Affinity is the primary affinity of the OSD
+	Affinity float64
+	// Up is true if the OSD is up
+	Up bool
+	// Exists is false for OSDs which have been removed
+	Exists bool
 }
 
-// Rack represents a datacenter rack. It contains Hosts.
-type Rack struct {
-	Id int
-	Parent *Row
-	Children map[string]*Host
+// Ancestor walks up the hierarchy from b, returning the first bucket
+// of type `typ`. b itself is considered. It returns nil if there is
+// no such bucket.
+func (b *CrushBucket) Ancestor(typ string) *CrushBucket {
+	for ; b != nil; b = b.Parent {
+		if b.Type == typ {
+			return b
+		}
+	}
+	return nil
 }
 
-// Host represents a machine running Ceph services. Svcs belong to it.
-type Host struct {
-	Id int
-	Parent *Rack
-	Children map[string]*OsdStat
+// Descendants returns every bucket of type `typ` under b, at any
+// depth. A bucket which is linked in more than one place under b is
+// only returned once.
+func (b *CrushBucket) Descendants(typ string) []*CrushBucket {
+	var found []*CrushBucket
+	seen := map[*CrushBucket]bool{}
+	b.walk(func(cb *CrushBucket) {
+		if cb.Type == typ && !seen[cb] {
+			seen[cb] = true
+			found = append(found, cb)
+		}
+	})
+	return found
+}
+
+// AllOsds returns every OSD under b, at any depth. An OSD which is
+// linked in more than one place under b is only returned once.
+func (b *CrushBucket) AllOsds() []*CrushOsd {
+	var osds []*CrushOsd
+	seen := map[*CrushOsd]bool{}
+	add := func(cb *CrushBucket) {
+		for _, o := range cb.Osds {
+			if !seen[o] {
+				seen[o] = true
+				osds = append(osds, o)
+			}
+		}
+	}
+	add(b)
+	b.walk(add)
+	return osds
+}
+
+// walk calls f on every bucket under b, depth first.
+func (b *CrushBucket) walk(f func(*CrushBucket)) {
+	for _, cb := range b.Buckets {
+		f(cb)
+		cb.walk(f)
+	}
+}
+
+// Ancestor returns the first bucket of type `typ` above the OSD, or
+// nil.
+func (o *CrushOsd) Ancestor(typ string) *CrushBucket {
+	return o.Parent.Ancestor(typ)
+}
+
+// Location returns the names of every bucket above the OSD, keyed by
+// bucket type.
+func (o *CrushOsd) Location() map[string]string {
+	loc := map[string]string{}
+	for b := o.Parent; b != nil; b = b.Parent {
+		loc[b.Type] = b.Name
+	}
+	return loc
 }
 
 // ClientUpdate is the struct used for interchange between whiplash clients
 // and the aggregator. Each network request consists of the request
 // name followed by whitespace followed by a JSON-encoded Request.
 type ClientUpdate struct {
-	// Time is the timestamp when the update was sent
+	// Time is the timestamp when the update was sent, by the
+	// client's clock. The aggregator only passes it on to its sinks;
+	// liveness is judged by when updates arrive.
 	Time int64
 
 	// Svc is the core identifying and status info about the service
@@ -62,57 +165,405 @@ type QueryResponse struct {
 	Data json.RawMessage `json:"data"`
 }
 
+// CapacityReport is a rollup of OSD capacity and state, for a
+// cluster, rack, or node.
+type CapacityReport struct {
+	// Name is the name of the thing being reported on
+	Name string
+	// Osds is the number of OSDs
+	Osds int
+	// OsdsReporting is the number of OSDs which are reporting
+	OsdsReporting int
+	// BytesUsed is the total data stored on the OSDs
+	BytesUsed int
+	// BytesAvail is the total space remaining on the OSDs
+	BytesAvail int
+	// BytesTotal is the total size of the OSDs' filesystems.
+	// Utilisation is BytesUsed / BytesTotal, as with an OSD's
+	// FillRatio.
+	BytesTotal int
+	// PgPrimary is the total count of primary PGs on the OSDs
+	PgPrimary int
+	// PgReplica is the total count of replica PGs on the OSDs
+	PgReplica int
+}
+
+// AddOsd adds an OSD's state into a CapacityReport. `stat` may be
+// nil, if no stat update has been seen for the OSD.
+func (c *CapacityReport) AddOsd(core *SvcCore, stat *OsdStat) {
+	c.Osds++
+	if core != nil && core.Reporting {
+		c.OsdsReporting++
+	}
+	if stat == nil {
+		return
+	}
+	c.BytesUsed += stat.BytesUsed
+	c.BytesAvail += stat.BytesAvail
+	c.BytesTotal += stat.BytesTotal
+	c.PgPrimary += stat.PgPrimary
+	c.PgReplica += stat.PgReplica
+}
+
+// Merge adds the totals from another CapacityReport into c.
+func (c *CapacityReport) Merge(o *CapacityReport) {
+	c.Osds += o.Osds
+	c.OsdsReporting += o.OsdsReporting
+	c.BytesUsed += o.BytesUsed
+	c.BytesAvail += o.BytesAvail
+	c.BytesTotal += o.BytesTotal
+	c.PgPrimary += o.PgPrimary
+	c.PgReplica += o.PgReplica
+}
+
+// ClusterReport is the response data for 'status cluster'.
+type ClusterReport struct {
+	CapacityReport
+	// Mons is the number of MONs
+	Mons int
+	// MonsReporting is the number of MONs which are reporting
+	MonsReporting int
+	// Rgws is the number of RGWs
+	Rgws int
+	// RgwsReporting is the number of RGWs which are reporting
+	RgwsReporting int
+	// Racks is the per-rack rollups, if CRUSH data is available
+	Racks []*CapacityReport
+	// Hosts is the per-host rollups
+	Hosts []*CapacityReport
+}
+
+// RackReport is the response data for 'status rack'.
+type RackReport struct {
+	CapacityReport
+	// Hosts is the per-host rollups for the rack
+	Hosts []*CapacityReport
+}
+
+// NodeReport is the response data for 'status node'.
+type NodeReport struct {
+	CapacityReport
+	// Svcs is all the services on the node
+	Svcs []*SvcCore
+	// OsdDetail is the detailed status of each OSD on the node
+	OsdDetail []*OsdReport
+}
+
+// OsdReport is the response data for 'status osd'.
+type OsdReport struct {
+	// Svc is the core status of the OSD
+	Svc *SvcCore
+	// Stat is the most recent stat data for the OSD. It will be nil
+	// if no stat update has been seen.
+	Stat *OsdStat
+	// LastPing is the timestamp of the most recent ping update
+	LastPing int64
+	// LastStat is the timestamp of the most recent stat update
+	LastStat int64
+}
+
+// TreeReport is the response data for 'status tree', which feeds the
+// web dashboard. It lays out the CRUSH hierarchy with the status of
+// every OSD in it, and lists every service the aggregator knows about.
+type TreeReport struct {
+	// Time is the aggregator's clock when the report was made, so
+	// that ages can be computed without trusting the reader's clock
+	Time int64
+	// Roots is the top-level buckets of the hierarchy
+	Roots []*TreeBucket
+	// Svcs is every known service, sorted by name
+	Svcs []*SvcReport
+}
+
+// TreeBucket is a CRUSH bucket in a TreeReport.
+type TreeBucket struct {
+	Name string
+	// Type is the bucket type name, e.g. "rack"
+	Type string
+	// Buckets is the child buckets of this bucket
+	Buckets []*TreeBucket
+	// Osds is the OSDs directly under this bucket. OSDs which have
+	// never reported have a Svc with only Name and Type set.
+	Osds []*OsdReport
+}
+
+// SvcReport is the status of a single service in a TreeReport.
+type SvcReport struct {
+	// Svc is the core status of the service
+	Svc *SvcCore
+	// LastPing is the timestamp of the most recent ping update
+	LastPing int64
+	// LastStat is the timestamp of the most recent stat update
+	LastStat int64
+}
+
+// LastSeenReport is the response data for 'lastseen'.
+type LastSeenReport struct {
+	// Time is the aggregator's clock when the report was made
+	Time int64
+	// Svcs is the requested services, least recently heard from
+	// first
+	Svcs []*SvcReport
+}
+
+// WhereReport is an element of the response data for 'where'.
+type WhereReport struct {
+	// Svc is the name of the service
+	Svc string
+	// Host is the node the service last reported from
+	Host string
+	// Location is the service's place in the CRUSH hierarchy, as
+	// bucket names keyed by bucket type. It is empty if the CRUSH
+	// map doesn't know where the service is.
+	Location map[string]string
+}
+
+// CrushReloadReport is the response data for 'crushreload'.
+type CrushReloadReport struct {
+	// Buckets is the number of buckets in the new CRUSH map
+	Buckets int
+	// BucketsChanged is the number of buckets added, removed, or
+	// altered by the reload
+	BucketsChanged int
+	// Osds is the number of OSDs in the new CRUSH map
+	Osds int
+	// OsdsChanged is the number of OSDs added, removed, or altered
+	// by the reload
+	OsdsChanged int
+}
+
 // OsdStat is the data we want to ship to the aggregator about an OSD
 // service's status
 type OsdStat struct {
-	// Weight is the crush weight of the OSD.
+	// Weight is the crush weight of the OSD. It is filled in by the
+	// aggregator, from the CRUSH map.
 	Weight float32
+	// Reweight is the override weight of the OSD. It is filled in by
+	// the aggregator, from the CRUSH map.
+	Reweight float32
 	// BytesUsed is the amount of data stored on the OSD
 	BytesUsed int
 	// BytesAvail is the space remaining on the OSD
 	BytesAvail int
+	// BytesTotal is the size of the OSD's filesystem
+	BytesTotal int
+	// FillRatio is BytesUsed / BytesTotal
+	FillRatio float64
+	// ReadLatency is the mean read op latency, in seconds, since the
+	// previous stat update
+	ReadLatency float64
+	// WriteLatency is the mean write op latency, in seconds, since
+	// the previous stat update
+	WriteLatency float64
+	// RWLatency is the mean read-modify-write op latency, in
+	// seconds, since the previous stat update
+	RWLatency float64
+	// RateInterval is the time, in seconds, since the previous stat
+	// sample. The rates below are computed over this interval; they
+	// are all 0 on the first sample.
+	RateInterval float64
+	// OpRate is client ops per second
+	OpRate float64
+	// ReadOpRate is client read ops per second
+	ReadOpRate float64
+	// WriteOpRate is client write ops per second
+	WriteOpRate float64
+	// RWOpRate is client read-modify-write ops per second
+	RWOpRate float64
+	// InBytesRate is client bytes written per second
+	InBytesRate float64
+	// OutBytesRate is client bytes read per second
+	OutBytesRate float64
+	// SubopRate is replication subops per second
+	SubopRate float64
+	// RecoveryOpRate is recovery ops per second
+	RecoveryOpRate float64
+	// PushRate is recovery pushes per second
+	PushRate float64
+	// PullRate is recovery pulls per second
+	PullRate float64
+	// Counters holds the values of any perf counters selected by the
+	// client's counter whitelist, keyed by "section.counter"
+	Counters map[string]float64 `json:",omitempty"`
 	// PgPrimary is the number of PGs for which the OSD is the primary
 	PgPrimary int
 	// PgReplica is the number of PGs for which the OSD is a replica
 	PgReplica int
 }
 
+// MonStat is the data we want to ship to the aggregator about a MON
+// service's status
+type MonStat struct {
+	// Rank is the MON's rank in the monmap
+	Rank int
+	// State is the MON's state: "leader", "peon", "electing", etc.
+	State string
+	// Leader is the name of the quorum leader, if there is a quorum
+	Leader string
+	// Quorum is the names of the MONs which are in quorum
+	Quorum []string
+	// OutOfQuorum is the names of the MONs in the monmap which are
+	// not in quorum
+	OutOfQuorum []string
+	// ElectionEpoch is the current election epoch
+	ElectionEpoch int
+	// PaxosCommits is the number of paxos commits done by this MON
+	PaxosCommits int
+	// PaxosCommitLatency is the mean paxos commit latency, in seconds
+	PaxosCommitLatency float64
+	// StoreBytes is the on-disk size of the MON's leveldb/rocksdb store
+	StoreBytes int64
+	// Sessions is the number of open sessions on the MON
+	Sessions int
+	// Counters holds the values of any perf counters selected by the
+	// client's counter whitelist, keyed by "section.counter"
+	Counters map[string]float64 `json:",omitempty"`
+}
+
+// RgwStat is the data we want to ship to the aggregator about an RGW
+// service's status
+type RgwStat struct {
+	// Req is the number of requests handled
+	Req int
+	// FailedReq is the number of requests which failed
+	FailedReq int
+	// Get is the number of GET requests
+	Get int
+	// GetBytes is the amount of data sent in response to GETs
+	GetBytes int
+	// GetLatency is the mean time to first byte of GETs, in seconds
+	GetLatency float64
+	// Put is the number of PUT requests
+	Put int
+	// PutBytes is the amount of data received via PUTs
+	PutBytes int
+	// PutLatency is the mean initial latency of PUTs, in seconds
+	PutLatency float64
+	// Qlen is the number of requests waiting in the queue
+	Qlen int
+	// Qactive is the number of requests being processed
+	Qactive int
+	// CacheHit is the number of metadata cache hits
+	CacheHit int
+	// CacheMiss is the number of metadata cache misses
+	CacheMiss int
+	// Counters holds the values of any perf counters selected by the
+	// client's counter whitelist, keyed by "section.counter"
+	Counters map[string]float64 `json:",omitempty"`
+}
+
+// SetCrush fills in the CRUSH-derived fields of an OsdStat.
+func (o *OsdStat) SetCrush(co *CrushOsd) {
+	o.Weight = float32(co.Weight)
+	o.Reweight = float32(co.Reweight)
+}
+
 // cephVersion represents the output of passing 'version' to a ceph admin daemon.
 type cephVersion struct {
 	Version string `json:"version"`
 }
 
+// cephPerfAvg is a Ceph long-running average counter, as found in
+// 'perf dump' output.
+type cephPerfAvg struct {
+	Avgcount int `json:"avgcount"`
+	Sum float64 `json:"sum"`
+}
+
+// Avg returns the average value of the counter over its lifetime.
+func (a cephPerfAvg) Avg() float64 {
+	if a.Avgcount == 0 {
+		return 0
+	}
+	return a.Sum / float64(a.Avgcount)
+}
+
+// Interval returns the average value of the counter over the
+// interval since an earlier sample, `prev`. If there were no events
+// in the interval, it returns 0. If the counter has gone backwards
+// (the daemon restarted), the lifetime average is returned instead.
+func (a cephPerfAvg) Interval(prev cephPerfAvg) float64 {
+	if a.Avgcount < prev.Avgcount || a.Sum < prev.Sum {
+		return a.Avg()
+	}
+	if a.Avgcount == prev.Avgcount {
+		return 0
+	}
+	return (a.Sum - prev.Sum) / float64(a.Avgcount-prev.Avgcount)
+}
+
+// cephMonPerfDump represents the output of passing 'perf dump' to a
+// MON admin daemon. Only the sections we use are decoded.
+type cephMonPerfDump struct {
+	Mon cephMonPerfDumpMon `json:"mon"`
+	Paxos cephMonPerfDumpPaxos `json:"paxos"`
+}
+
+// cephMonPerfDumpMon is the "mon" section of a MON 'perf dump'
+type cephMonPerfDumpMon struct {
+	NumSessions int `json:"num_sessions"`
+	SessionAdd int `json:"session_add"`
+	SessionRm int `json:"session_rm"`
+	SessionTrim int `json:"session_trim"`
+	NumElections int `json:"num_elections"`
+	ElectionCall int `json:"election_call"`
+	ElectionWin int `json:"election_win"`
+	ElectionLose int `json:"election_lose"`
+}
+
+// cephMonPerfDumpPaxos is the "paxos" section of a MON 'perf dump'
+type cephMonPerfDumpPaxos struct {
+	Commit int `json:"commit"`
+	CommitLatency cephPerfAvg `json:"commit_latency"`
+}
+
+// cephMonStatus represents the output of passing 'mon_status' to a
+// MON admin daemon.
+type cephMonStatus struct {
+	Name string `json:"name"`
+	Rank int `json:"rank"`
+	State string `json:"state"`
+	ElectionEpoch int `json:"election_epoch"`
+	// Quorum is the ranks of the MONs in quorum
+	Quorum []int `json:"quorum"`
+	Monmap struct {
+		Epoch int `json:"epoch"`
+		Mons []struct {
+			Rank int `json:"rank"`
+			Name string `json:"name"`
+		} `json:"mons"`
+	} `json:"monmap"`
+}
+
+// cephRgwPerfDump represents the output of passing 'perf dump' to an
+// RGW admin daemon. Only the rgw section is decoded.
+type cephRgwPerfDump struct {
+	Rgw cephRgwPerfDumpRgw `json:"rgw"`
+}
+
+// cephRgwPerfDumpRgw is the "rgw" section of an RGW 'perf dump'
+type cephRgwPerfDumpRgw struct {
+	Req int `json:"req"`
+	FailedReq int `json:"failed_req"`
+	Get int `json:"get"`
+	GetB int `json:"get_b"`
+	GetInitialLat cephPerfAvg `json:"get_initial_lat"`
+	Put int `json:"put"`
+	PutB int `json:"put_b"`
+	PutInitialLat cephPerfAvg `json:"put_initial_lat"`
+	Qlen int `json:"qlen"`
+	Qactive int `json:"qactive"`
+	CacheHit int `json:"cache_hit"`
+	CacheMiss int `json:"cache_miss"`
+}
+
 // cephOsdPerfDump represents the output of passing 'perf dump' to an
-// OSD admin daemon.
+// OSD admin daemon. Only the osd section, which holds the data we
+// always want, is decoded here. It is common to all OSD backends and
+// releases; everything else is handled by the generic perf dump
+// decoder.
 type cephOsdPerfDump struct {
-	WBThrottle json.RawMessage `json:"WBThrottle"`
-	Filestore json.RawMessage `json:"filestore"`
-	LevelDB json.RawMessage `json:"leveldb"`
-	MutexFJCL json.RawMessage `json:"mutex-FileJournal::completions_lock"`
-	MutexFJFL json.RawMessage `json:"mutex-FileJournal::finisher_lock"`
-	MutexFJWL json.RawMessage `json:"mutex-FileJournal::write_lock"`
-	MutexFHWQL json.RawMessage `json:"mutex-FileJournal::writeq_lock"`
-	MutexJAMAL json.RawMessage `json:"mutex-JOS::ApplyManager::apply_lock"`
-	MutexJAMCL json.RawMessage `json:"mutex-JOS::ApplyManager::com_lock"`
-	MutexJSML json.RawMessage `json:"mutex-JOS::SubmitManager::lock"`
-	MutexWBTL json.RawMessage `json:"mutex-WBThrottle::lock"`
-	Objecter json.RawMessage `json:"objecter"`
-	// Osd is currently the only thing we care about in here. It holds
-	// tons of data about how the OSD is currently looking.
 	Osd cephOsdPerfDumpOsd `json:"osd"`
-	RecoveryState json.RawMessage `json:"recoverystate_perf"`
-	ThrottleFSBytes json.RawMessage `json:"throttle-filestore_bytes"`
-	ThrottleFSOps json.RawMessage `json:"throttle-filestore_ops"`
-	ThrottleMDTCli json.RawMessage `json:"throttle-msgr_dispatch_throttler-client"`
-	ThrottleMDTClu json.RawMessage `json:"throttle-msgr_dispatch_throttler-cluster"`
-	ThrottleMDTHBBS json.RawMessage `json:"throttle-msgr_dispatch_throttler-hb_back_server"`
-	ThrottleMDTHBFS json.RawMessage `json:"throttle-msgr_dispatch_throttler-hb_front_server"`
-	ThrottleMDTHBC json.RawMessage `json:"throttle-msgr_dispatch_throttler-hbclient"`
-	ThrottleMDTMO json.RawMessage `json:"throttle-msgr_dispatch_throttler-ms_objecter"`
-	ThrottleObjBytes json.RawMessage `json:"throttle-objecter_bytes"`
-	ThrottleObjOps json.RawMessage `json:"throttle-objecter_ops"`
-	ThrottleOsdCB json.RawMessage `json:"throttle-osd_client_bytes"`
-	ThrottleOsdCM json.RawMessage `json:"throttle-osd_client_messages"`
 }
 
 // cephOsdPerfDumpOsd is the "osd" section of the output of "perf dump"
@@ -121,34 +572,34 @@ type cephOsdPerfDumpOsd struct {
 	Op int `json:"op"`
 	OpInBytes int `json:"op_in_bytes"`
 	OpOutBytes int `json:"op_out_bytes"`
-	OpLatency json.RawMessage `json:"op_latency"`
-	OpProcessLatency json.RawMessage `json:"op_process_latency"`
+	OpLatency cephPerfAvg `json:"op_latency"`
+	OpProcessLatency cephPerfAvg `json:"op_process_latency"`
 	OpR int `json:"op_r"`
 	OpROutBytes int `json:"op_r_out_bytes"`
-	OpRLatency json.RawMessage `json:"op_r_latency"`
-	OpRProcessLatency json.RawMessage `json:"op_r_process_latency"`
+	OpRLatency cephPerfAvg `json:"op_r_latency"`
+	OpRProcessLatency cephPerfAvg `json:"op_r_process_latency"`
 	OpW int `json:"op_w"`
 	OpWInBytes int `json:"op_w_in_bytes"`
-	OpWRLatency json.RawMessage `json:"op_w_rlat"`
-	OpWLatency json.RawMessage `json:"op_w_latency"`
-	OpWProcessLatency json.RawMessage `json:"op_w_process_latency"`
+	OpWRLatency cephPerfAvg `json:"op_w_rlat"`
+	OpWLatency cephPerfAvg `json:"op_w_latency"`
+	OpWProcessLatency cephPerfAvg `json:"op_w_process_latency"`
 	OpRW int `json:"op_rw"`
 	OpRWInBytes int `json:"op_rw_in_bytes"`
 	OpRWOutBytes int `json:"op_rw_out_bytes"`
-	OpRWRLatency json.RawMessage `json:"op_rw_rlat"`
-	OpRWLatency json.RawMessage `json:"op_rw_latency"`
-	OpRWProcessLatency json.RawMessage `json:"op_rw_process_latency"`
+	OpRWRLatency cephPerfAvg `json:"op_rw_rlat"`
+	OpRWLatency cephPerfAvg `json:"op_rw_latency"`
+	OpRWProcessLatency cephPerfAvg `json:"op_rw_process_latency"`
 	Subop int `json:"subop"`
 	SubopInBytes int `json:"subop_in_bytes"`
-	SubopLatency json.RawMessage `json:"subop_latency"`
+	SubopLatency cephPerfAvg `json:"subop_latency"`
 	SubopW int `json:"subop_w"`
 	SubopWInBytes int `json:"subop_w_in_bytes"`
-	SubopWLatency json.RawMessage `json:"subop_w_latency"`
+	SubopWLatency cephPerfAvg `json:"subop_w_latency"`
 	SubopPull int `json:"subop_pull"`
-	SubopPullLatency json.RawMessage `json:"subop_pull_latency"`
+	SubopPullLatency cephPerfAvg `json:"subop_pull_latency"`
 	SubopPush int `json:"subop_push"`
 	SubopPushInBytes int `json:"subop_push_in_bytes"`
-	SubopPushLatency json.RawMessage `json:"subop_push_latency"`
+	SubopPushLatency cephPerfAvg `json:"subop_push_latency"`
 	Pull int `json:"pull"`
 	Push int `json:"push"`
 	PushOutBytes int `json:"push_out_bytes"`